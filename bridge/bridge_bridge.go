@@ -2,18 +2,39 @@ package bridge
 
 import (
 	"fmt"
+	"net"
+	"os/exec"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/libnetwork/iptables"
 	"github.com/docker/libcontainer/netlink"
+	vnetlink "github.com/vishvananda/netlink"
 )
 
-//  setupBridge If bridge does not exist create it.
-func (d *Driver) initBridge(id string) error {
-	bridgeName := d.networks[id].BridgeName
-	// Add bridge
-	if err := netlink.NetworkLinkAdd(bridgeName, "bridge"); err != nil {
+//  setupBridge If bridge does not exist create it. An existing link is only
+// taken when reuse is set, when reconciling, and only if it is the bridge
+// the plugin created for the network.
+func (d *Driver) initBridge(id string, reuse bool) error {
+	network, err := d.getNetwork(id)
+	if err != nil {
+		return err
+	}
+	if isChildMode(network.Mode) {
+		return initParent(network, id)
+	}
+	bridgeName := network.BridgeName
+	// Add bridge, an existing one is reused so that the bridge of a
+	// network can be set up again after a restart
+	exists, err := ownBridge(bridgeName, id, reuse)
+	if err != nil {
+		log.Errorf("Could not set up bridge [ %s ]: %s", bridgeName, err)
+		return err
+	}
+	if exists {
+		log.Debugf("Reusing existing linux bridge [ %s ]", bridgeName)
+	} else if err := netlink.NetworkLinkAdd(bridgeName, "bridge"); err != nil {
 		log.Errorf("error creating linux bridge [ %s ] : [ %s ]", bridgeName, err)
 		return err
 	}
@@ -32,47 +53,233 @@ func (d *Driver) initBridge(id string) error {
 
 	}
 
-	bridgeMode := d.networks[id].Mode
+	// Mark the bridge as ours so the garbage collector can tell it apart
+	// from bridges created by docker or by hand
+	if err := setIfaceAlias(bridgeName, bridgeAliasPrefix+id); err != nil {
+		log.Warnf("Could not set alias on bridge [ %s ]: %s", bridgeName, err)
+	}
+
+	bridgeMode := network.Mode
 	switch bridgeMode {
-	case modeNAT:
+	case modeNAT, modeVxlan:
 		{
-			gatewayIP := d.networks[id].Gateway + "/" + d.networks[id].GatewayMask
-			if err := setInterfaceIP(bridgeName, gatewayIP); err != nil {
-				log.Debugf("Error assigning address: %s on bridge: %s with an error of: %s", gatewayIP, bridgeName, err)
-			}
+			setGateways(network, false)
 
 			// Validate that the IPAddress is there!
-			_, err := getIfaceAddr(bridgeName)
+			_, err := getIfaceAddr(bridgeName, vnetlink.FAMILY_V4)
 			if err != nil {
-				log.Fatalf("No IP address found on bridge %s", bridgeName)
+				log.Errorf("No IP address found on bridge %s: %s", bridgeName, err)
 				return err
 			}
 
-			// Add NAT rules for iptables
-			if err = addNatOut(gatewayIP, bridgeName); err != nil {
-				log.Fatalf("Could not set NAT rules for bridge %s", bridgeName)
+			if network.Internal {
+				// Internal networks never get out, not even through NAT
+				if err := addInternalRules(bridgeName, network.Gateway6 != ""); err != nil {
+					log.Errorf("Could not set isolation rules for bridge %s: %s", bridgeName, err)
+					return err
+				}
+			} else {
+				// Add NAT rules for iptables
+				for _, pool := range network.pools() {
+					if pool.ipv6() || pool.Gateway == "" {
+						continue
+					}
+					if err = addNatOut(pool.gatewayCIDR(), bridgeName); err != nil {
+						log.Errorf("Could not set NAT rules for bridge %s: %s", bridgeName, err)
+						return err
+					}
+				}
+			}
+		}
+
+	case modeRouted:
+		{
+			// The gateways answer on every veth, but nothing is NATed
+			setGateways(network, false)
+			if err := setSysctl("net/ipv4/ip_forward", "1"); err != nil {
 				return err
 			}
 		}
 
 	case modeFlat:
 		{
-			//ToDo: Add NIC to the bridge
+			if network.FlatBindInterface == "" {
+				return fmt.Errorf("%s mode needs %s", modeFlat, bindInterfaceOption)
+			}
+			// Put the bridge on the physical segment, the gateway is the
+			// segment's router rather than the bridge. A tagged network
+			// uses the vlan subinterface below instead.
+			if network.VlanID == 0 {
+				if err := attachUplink(bridgeName, network.FlatBindInterface, true); err != nil {
+					log.Errorf("Could not attach [ %s ] to bridge [ %s ]: %s", network.FlatBindInterface, bridgeName, err)
+					return err
+				}
+			}
+		}
+	}
+
+	if network.Gateway6 != "" && network.Mode != modeFlat {
+		if err := setupIPv6(network); err != nil {
+			log.Errorf("Could not set up IPv6 on bridge [ %s ]: %s", bridgeName, err)
+			return err
+		}
+	}
+
+	// Auxiliary addresses for the host go on the bridge in every mode
+	for _, pool := range network.pools() {
+		for _, addr := range pool.hostAddresses() {
+			ip, _, _ := net.ParseCIDR(addr)
+			if ifaceHasAddr(bridgeName, ip) {
+				continue
+			}
+			if err := setInterfaceIP(bridgeName, addr); err != nil {
+				log.Warnf("Could not add host address [ %s ] to bridge [ %s ]: %s", addr, bridgeName, err)
+			}
+		}
+	}
+
+	if network.VlanID != 0 {
+		if err := createVlan(network.FlatBindInterface, network.VlanInterface, network.VlanID, id); err != nil {
+			return err
+		}
+		if err := attachUplink(bridgeName, network.VlanInterface, false); err != nil {
+			log.Errorf("Could not attach [ %s ] to bridge [ %s ]: %s", network.VlanInterface, bridgeName, err)
+			return err
+		}
+	}
+
+	if network.Mode == modeVxlan {
+		if err := setupVxlan(id, network); err != nil {
+			log.Errorf("Could not set up vxlan for bridge [ %s ]: %s", bridgeName, err)
+			return err
+		}
+	}
+
+	// Uplinks first, a bridge does not go above the MTU of its ports
+	if network.MTU > 0 {
+		for _, name := range []string{network.VlanInterface, network.VxlanInterface, bridgeName} {
+			if name == "" {
+				continue
+			}
+			if err := setLinkMTU(name, network.MTU); err != nil {
+				log.Warnf("%s", err)
+			}
 		}
 	}
 
 	// Bring the bridge up
-	err := interfaceUp(bridgeName)
+	err = interfaceUp(bridgeName)
 	if err != nil {
 		log.Warnf("Error enabling bridge: [ %s ]", err)
 		return err
 	}
 
+	if network.DisableICC {
+		if err := addIccRules(network); err != nil {
+			log.Errorf("Could not set ICC rules for bridge %s: %s", bridgeName, err)
+			return err
+		}
+	}
+	if isolated(network) {
+		if err := d.updateIsolation(); err != nil {
+			log.Errorf("Could not update isolation rules for bridge %s: %s", bridgeName, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// delHostAddresses takes the auxiliary host addresses off the bridge
+func delHostAddresses(network *NetworkState) {
+	for _, pool := range network.pools() {
+		for _, addr := range pool.hostAddresses() {
+			if err := delInterfaceIP(network.BridgeName, addr); err != nil {
+				log.Warnf("Could not delete host address [ %s ] from bridge [ %s ]: %s", addr, network.BridgeName, err)
+			}
+		}
+	}
+}
+
+// ownBridge tells whether the bridge of a network is already there. Links
+// the plugin did not create for the network are never taken over, they
+// would be deleted along with it.
+func ownBridge(bridgeName, id string, reuse bool) (bool, error) {
+	link, err := vnetlink.LinkByName(bridgeName)
+	if err != nil {
+		return false, nil
+	}
+	if reuse && link.Type() == "bridge" && link.Attrs().Alias == bridgeAliasPrefix+id {
+		return true, nil
+	}
+	return false, fmt.Errorf("interface %s already exists and is not the bridge of network %s", bridgeName, id)
+}
+
+// setupIPv6 gives the bridge its IPv6 gateway. IPv6 is routed unless the
+// network asked for NAT66.
+func setupIPv6(network *NetworkState) error {
+	bridgeName := network.BridgeName
+	if err := setSysctl("net/ipv6/conf/"+bridgeName+"/disable_ipv6", "0"); err != nil {
+		return err
+	}
+	setGateways(network, true)
+	if network.Internal {
+		return nil
+	}
+	if err := setSysctl("net/ipv6/conf/all/forwarding", "1"); err != nil {
+		return err
+	}
+	if !network.IPv6NAT {
+		return nil
+	}
+	for _, pool := range network.pools() {
+		if !pool.ipv6() || pool.Gateway == "" {
+			continue
+		}
+		if err := addNat66Out(pool.gatewayCIDR(), bridgeName); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// deleteBridge deletes the linux bridge
-func deleteBridge(bridgeName string) error {
+// setGateways puts the gateway of every pool of a family on the bridge
+func setGateways(network *NetworkState, ipv6 bool) {
+	for _, pool := range network.pools() {
+		if pool.ipv6() != ipv6 || pool.Gateway == "" {
+			continue
+		}
+		if ifaceHasAddr(network.BridgeName, net.ParseIP(pool.Gateway)) {
+			continue
+		}
+		gatewayIP := pool.gatewayCIDR()
+		if err := setInterfaceIP(network.BridgeName, gatewayIP); err != nil {
+			log.Debugf("Error assigning address: %s on bridge: %s with an error of: %s", gatewayIP, network.BridgeName, err)
+		}
+	}
+}
+
+// deleteBridge deletes the linux bridge and the vlan or vxlan interface it
+// uplinks to
+func deleteBridge(network *NetworkState) error {
+	bridgeName := network.BridgeName
+	for _, uplink := range []string{network.VlanInterface, network.VxlanInterface} {
+		if uplink == "" {
+			continue
+		}
+		if err := deleteLink(uplink); err != nil {
+			log.Errorf("error deleting uplink [ %s ] : [ %s ]", uplink, err)
+			return err
+		}
+	}
+	if bridgeName == "" {
+		return nil
+	}
+	if isolated(network) {
+		delIsolation(bridgeName)
+	}
+	if network.DisableICC {
+		delIccRules(network)
+	}
 	if err := netlink.NetworkLinkDel(bridgeName); err != nil {
 		log.Errorf("error delete linux bridge [ %s ] : [ %s ]", bridgeName, err)
 		return err
@@ -88,6 +295,7 @@ func addNatOut(cidr string, intfName string) error {
 		"POSTROUTING", "-t", "nat",
 		"!", "-o", intfName,
 		"-s", cidr,
+		"-m", "comment", "--comment", ruleComment,
 		"-j", "MASQUERADE",
 	}
 	if _, err := iptables.Raw(
@@ -111,12 +319,14 @@ func delNatOut(cidr string, intfName string) error {
 		"POSTROUTING", "-t", "nat",
 		"!", "-o", intfName,
 		"-s", cidr,
+		"-m", "comment", "--comment", ruleComment,
 		"-j", "MASQUERADE",
 	}
 	if _, err := iptables.Raw(
 		append([]string{"-C"}, masquerade...)...,
 	); err != nil {
 		log.Errorln("Can't find NAT rule in POSTROUTING chain!")
+		return nil
 	}
 
 	incl := append([]string{"-D"}, masquerade...)
@@ -137,6 +347,7 @@ func addFipDnat(fipStr string, lipStr string, intfName string) error {
 		"DOCKER", "-t", "nat",
 		"-d", fipStr,
 		"!", "-i", intfName,
+		"-m", "comment", "--comment", ruleComment,
 		"-j", "DNAT", "--to-destination", lipStr,
 	}
 	if _, err := iptables.Raw(
@@ -160,12 +371,14 @@ func delFipDnat(fipStr string, lipStr string, intfName string) error {
 		"DOCKER", "-t", "nat",
 		"-d", fipStr,
 		"!", "-i", intfName,
+		"-m", "comment", "--comment", ruleComment,
 		"-j", "DNAT", "--to-destination", lipStr,
 	}
 	if _, err := iptables.Raw(
 		append([]string{"-C"}, masquerade...)...,
 	); err != nil {
-		log.Errorln("Can't find NAT rule in POSTROUTING chain!")
+		log.Errorln("Can't find DNAT rule in DOCKER chain!")
+		return nil
 	}
 
 	incl := append([]string{"-D"}, masquerade...)
@@ -180,3 +393,143 @@ func delFipDnat(fipStr string, lipStr string, intfName string) error {
 	return nil
 }
 
+// internalRules drop everything forwarded between the bridge and any other
+// interface, traffic between containers of the bridge is left alone
+func internalRules(intfName string) [][]string {
+	return [][]string{
+		{
+			"FORWARD",
+			"-i", intfName,
+			"!", "-o", intfName,
+			"-m", "comment", "--comment", ruleComment,
+			"-j", "DROP",
+		},
+		{
+			"FORWARD",
+			"!", "-i", intfName,
+			"-o", intfName,
+			"-m", "comment", "--comment", ruleComment,
+			"-j", "DROP",
+		},
+	}
+}
+
+// internalRaws are the iptables commands the isolation rules of a network
+// go through, ip6tables as well when it has IPv6
+func internalRaws(ipv6 bool) []func(...string) ([]byte, error) {
+	raws := []func(...string) ([]byte, error){iptables.Raw}
+	if ipv6 {
+		raws = append(raws, ip6tablesRaw)
+	}
+	return raws
+}
+
+func addInternalRules(intfName string, ipv6 bool) error {
+	for _, raw := range internalRaws(ipv6) {
+		for _, rule := range internalRules(intfName) {
+			if _, err := raw(
+				append([]string{"-C"}, rule...)...,
+			); err == nil {
+				continue
+			}
+			incl := append([]string{"-I"}, rule...)
+			if output, err := raw(incl...); err != nil {
+				return err
+			} else if len(output) > 0 {
+				return &iptables.ChainError{
+					Chain:  "FORWARD",
+					Output: output,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func delInternalRules(intfName string, ipv6 bool) error {
+	for _, raw := range internalRaws(ipv6) {
+		for _, rule := range internalRules(intfName) {
+			if _, err := raw(
+				append([]string{"-C"}, rule...)...,
+			); err != nil {
+				log.Errorln("Can't find isolation rule in FORWARD chain!")
+				continue
+			}
+			incl := append([]string{"-D"}, rule...)
+			if output, err := raw(incl...); err != nil {
+				return err
+			} else if len(output) > 0 {
+				return &iptables.ChainError{
+					Chain:  "FORWARD",
+					Output: output,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ip6tablesRaw calls ip6tables with the arguments given, the way
+// iptables.Raw calls iptables. libnetwork only knows about IPv4.
+func ip6tablesRaw(args ...string) ([]byte, error) {
+	path, err := exec.LookPath("ip6tables")
+	if err != nil {
+		return nil, err
+	}
+	output, err := exec.Command(path, append([]string{"--wait"}, args...)...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ip6tables failed: ip6tables %v: %s (%s)", strings.Join(args, " "), output, err)
+	}
+	return output, nil
+}
+
+func addNat66Out(cidr string, intfName string) error {
+	masquerade := []string{
+		"POSTROUTING", "-t", "nat",
+		"!", "-o", intfName,
+		"-s", cidr,
+		"-m", "comment", "--comment", ruleComment,
+		"-j", "MASQUERADE",
+	}
+	if _, err := ip6tablesRaw(
+		append([]string{"-C"}, masquerade...)...,
+	); err != nil {
+		incl := append([]string{"-I"}, masquerade...)
+		if output, err := ip6tablesRaw(incl...); err != nil {
+			return err
+		} else if len(output) > 0 {
+			return &iptables.ChainError{
+				Chain:  "POSTROUTING",
+				Output: output,
+			}
+		}
+	}
+	return nil
+}
+
+func delNat66Out(cidr string, intfName string) error {
+	masquerade := []string{
+		"POSTROUTING", "-t", "nat",
+		"!", "-o", intfName,
+		"-s", cidr,
+		"-m", "comment", "--comment", ruleComment,
+		"-j", "MASQUERADE",
+	}
+	if _, err := ip6tablesRaw(
+		append([]string{"-C"}, masquerade...)...,
+	); err != nil {
+		log.Errorln("Can't find NAT66 rule in POSTROUTING chain!")
+		return nil
+	}
+
+	incl := append([]string{"-D"}, masquerade...)
+	if output, err := ip6tablesRaw(incl...); err != nil {
+		return err
+	} else if len(output) > 0 {
+		return &iptables.ChainError{
+			Chain:  "POSTROUTING",
+			Output: output,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package bridge
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// childPrefix names the macvlan and ipvlan links handed to containers
+const childPrefix = "br-child-"
+
+// isChildMode tells whether containers of a network get a child link of the
+// bind interface instead of a veth on a bridge
+func isChildMode(mode string) bool {
+	return mode == modeMacvlan || mode == modeIPVlan
+}
+
+func childLinkName(suffix string) string {
+	return childPrefix + suffix
+}
+
+// childParent is the interface the child links of a network hang off
+func childParent(network *NetworkState) string {
+	if network.VlanInterface != "" {
+		return network.VlanInterface
+	}
+	return network.FlatBindInterface
+}
+
+// initParent prepares the bind interface of a macvlan or ipvlan network,
+// which has no bridge
+func initParent(network *NetworkState, id string) error {
+	if network.FlatBindInterface == "" {
+		return fmt.Errorf("%s mode needs %s", network.Mode, bindInterfaceOption)
+	}
+	if network.VlanID != 0 {
+		if err := createVlan(network.FlatBindInterface, network.VlanInterface, network.VlanID, id); err != nil {
+			return err
+		}
+		if network.MTU > 0 {
+			if err := setLinkMTU(network.VlanInterface, network.MTU); err != nil {
+				log.Warnf("%s", err)
+			}
+		}
+	}
+	return interfaceUp(childParent(network))
+}
+
+// createChildLink adds the macvlan or ipvlan link of an endpoint. It stays
+// down in the host namespace until docker moves it into the container.
+func createChildLink(network *NetworkState, name string, mac string) error {
+	parent, err := netlink.LinkByName(childParent(network))
+	if err != nil {
+		return fmt.Errorf("parent interface %s not found: %s", childParent(network), err)
+	}
+	attrs := netlink.LinkAttrs{
+		Name:        name,
+		ParentIndex: parent.Attrs().Index,
+		MTU:         network.MTU,
+	}
+	var link netlink.Link
+	switch network.Mode {
+	case modeMacvlan:
+		mode := netlink.MACVLAN_MODE_BRIDGE
+		if network.DisableICC {
+			// Private links can't reach the other links of the parent
+			mode = netlink.MACVLAN_MODE_PRIVATE
+		}
+		link = &netlink.Macvlan{LinkAttrs: attrs, Mode: mode}
+	case modeIPVlan:
+		link = &netlink.IPVlan{LinkAttrs: attrs, Mode: netlink.IPVLAN_MODE_L2}
+	default:
+		return fmt.Errorf("%s mode has no child links", network.Mode)
+	}
+	if err := netlink.LinkAdd(link); err != nil {
+		return fmt.Errorf("could not create %s link %s: %s", network.Mode, name, err)
+	}
+	// LinkAdd leaves out the MAC, it is set like the one of a veth
+	if err := setLinkMac(name, mac); err != nil {
+		netlink.LinkDel(link)
+		return fmt.Errorf("could not set the MAC of %s link %s: %s", network.Mode, name, err)
+	}
+	log.Infof("Created %s link [ %s ] on [ %s ]", network.Mode, name, parent.Attrs().Name)
+	return nil
+}
@@ -1,8 +1,148 @@
 package bridge
 
-import "github.com/samalba/dockerclient"
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/samalba/dockerclient"
+)
 
 type dockerer struct {
 	client *dockerclient.DockerClient
 }
 
+// containerInfo is the part of the container inspect output the driver
+// cares about. dockerclient's ContainerInfo predates the network settings
+// added in docker 1.9, so the daemon is asked directly.
+type containerInfo struct {
+	Id     string
+	Name   string
+	Config struct {
+		Labels map[string]string
+	}
+	NetworkSettings struct {
+		SandboxKey string
+		Networks   map[string]struct {
+			EndpointID string
+		}
+	}
+}
+
+// networkInfo is the network inspect output, including the driver options
+// that dockerclient's NetworkResource leaves out
+type networkInfo struct {
+	Name     string
+	Id       string
+	Driver   string
+	Internal bool
+	IPAM     struct {
+		Config []struct {
+			Subnet     string
+			Gateway    string
+			AuxAddress map[string]string `json:"AuxiliaryAddresses"`
+		}
+	}
+	Containers map[string]endpointInfo
+	Options    map[string]string
+}
+
+// endpointInfo is an endpoint of a container as listed by network inspect
+type endpointInfo struct {
+	EndpointID  string
+	MacAddress  string
+	IPv4Address string
+	IPv6Address string
+}
+
+// get decodes the answer of a GET on the docker API into v
+func (d *dockerer) get(path string, v interface{}) error {
+	resp, err := d.client.HTTPClient.Get(d.client.URL.String() + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (d *dockerer) inspectContainer(id string) (*containerInfo, error) {
+	info := &containerInfo{}
+	if err := d.get("/containers/"+id+"/json", info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// listNetworks returns the networks docker knows about that use driver
+func (d *dockerer) listNetworks(driver string) ([]*networkInfo, error) {
+	all := []*networkInfo{}
+	if err := d.get("/networks", &all); err != nil {
+		return nil, err
+	}
+	networks := []*networkInfo{}
+	for _, n := range all {
+		if n.Driver != driver {
+			continue
+		}
+		// The listing does not include the endpoints on older daemons
+		if n.Containers == nil {
+			info := &networkInfo{}
+			if err := d.get("/networks/"+n.Id, info); err != nil {
+				return nil, err
+			}
+			n = info
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// containerSummary is a container as listed by the docker daemon
+type containerSummary struct {
+	Id              string
+	NetworkSettings struct {
+		Networks map[string]struct {
+			EndpointID string
+		}
+	}
+}
+
+// containerForEndpoint asks the docker daemon which container the endpoint
+// belongs to, matching on the endpoint ID or on the sandbox it joined. Only
+// the containers attached to the network are listed, and only those are
+// inspected that the listing can not rule out.
+func (d *dockerer) containerForEndpoint(networkID, endpointID, sandboxKey string) (*containerInfo, error) {
+	filters, err := json.Marshal(map[string][]string{"network": {networkID}})
+	if err != nil {
+		return nil, err
+	}
+	containers := []containerSummary{}
+	if err := d.get("/containers/json?all=1&filters="+url.QueryEscape(string(filters)), &containers); err != nil {
+		return nil, err
+	}
+	for _, c := range containers {
+		for _, n := range c.NetworkSettings.Networks {
+			if n.EndpointID == endpointID {
+				return d.inspectContainer(c.Id)
+			}
+		}
+	}
+	if sandboxKey == "" {
+		return nil, fmt.Errorf("no container found for endpoint %s", endpointID)
+	}
+	// The endpoint may not be listed yet while docker is still joining it
+	for _, c := range containers {
+		info, err := d.inspectContainer(c.Id)
+		if err != nil {
+			continue
+		}
+		if info.NetworkSettings.SandboxKey == sandboxKey {
+			return info, nil
+		}
+	}
+	return nil, fmt.Errorf("no container found for endpoint %s", endpointID)
+}
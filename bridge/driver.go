@@ -1,12 +1,16 @@
 package bridge
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/gopher-net/dknet"
+	"github.com/chenleji/docker-bridge-plugin/dknet"
 	"github.com/samalba/dockerclient"
 	"github.com/vishvananda/netlink"
 )
@@ -17,39 +21,107 @@ const (
 	bridgePrefix     = "br-"
 	containerEthName = "eth"
 
+	// ruleComment tags the iptables rules the driver programs and
+	// bridgeAliasPrefix the bridges it owns, for the garbage collector
+	ruleComment       = "docker-bridge-plugin"
+	bridgeAliasPrefix = "docker-bridge-plugin:"
+
+	// genericOption is the key docker nests the -o network options under
+	genericOption = "com.docker.network.generic"
+
+	// Network options, networkConfig reads them by the same names
 	mtuOption           = "bridge.mtu"
 	modeOption          = "bridge.mode"
 	bridgeNameOption    = "bridge.name"
 	bindInterfaceOption = "bridge.bind_interface"
+	vlanOption          = "bridge.vlan"
+	vxlanIDOption       = "bridge.vxlan.vni"
+	vxlanPeersOption    = "bridge.vxlan.peers"
+	vxlanGroupOption    = "bridge.vxlan.group"
+	vxlanPortOption     = "bridge.vxlan.port"
+	internalOption      = "bridge.internal"
+	ipv6NATOption       = "bridge.ipv6_nat"
+	allowNetworksOption = "bridge.allow_networks"
+	enableICCOption     = "bridge.enable_icc"
+
+	// dockerInternalOption is set by docker network create --internal
+	dockerInternalOption = "com.docker.network.internal"
 
-	modeNAT  = "nat"
-	modeFlat = "flat"
+	// fipOption is read from the endpoint options and, failing that, from
+	// the container labels. It is one of fipAuto, fipNone or an IPv4 address.
+	fipOption = "bridge.fip"
+	fipAuto   = "auto"
+	fipNone   = "none"
+
+	modeNAT     = "nat"
+	modeFlat    = "flat"
+	modeVxlan   = "vxlan"
+	modeRouted  = "routed"
+	modeMacvlan = "macvlan"
+	modeIPVlan  = "ipvlan"
 
 	defaultMTU  = 1500
 	defaultMode = modeNAT
+
+	containerLookupRetries = 10
+
+	// dockerAPITimeout bounds every call to the docker daemon, which may be
+	// busy waiting on the plugin itself
+	dockerAPITimeout = 10 * time.Second
+
+	scopeLocal  = "local"
+	scopeGlobal = "global"
+
+	// networkKeyPrefix is where network definitions live in the cluster store
+	networkKeyPrefix = "networks/"
 )
 
 var (
 	validModes = map[string]bool{
-		modeNAT:  true,
-		modeFlat: true,
+		modeNAT:     true,
+		modeFlat:    true,
+		modeVxlan:   true,
+		modeRouted:  true,
+		modeMacvlan: true,
+		modeIPVlan:  true,
 	}
 )
 
+// Driver serves every request on its own goroutine. Requests for the same
+// network are serialized by a per network lock, mu only guards the maps.
+// Requests hold opLock shared, whole host sweeps such as the garbage
+// collector and reconciliation take it exclusively so they never see a
+// request half done.
 type Driver struct {
 	dknet.Driver
 	dockerer
-	networks map[string]*NetworkState
+	*ipam
+	name      string
+	scope     string
+	cluster   kvStore
+	mu        sync.Mutex
+	opLock    sync.RWMutex
+	netLocks  map[string]*sync.Mutex
+	networks  map[string]*NetworkState
 	endpoints map[string]*EndpointState
-
+	fips      *fipPool
+	store     *stateStore
+	saved     *driverState
 }
 
 type EndpointState struct {
+	NetworkID string
 	Container string
 	Fip string
 	Lip string
+	Lip6 string
+	Mac string
 	FipIfName string
 	OriginGateway string
+	FipRequest string
+	SandboxKey string
+	Ports []PortBinding
+	ExposedPorts []TransportPort
 }
 
 // NetworkState is filled in at network creation time
@@ -60,104 +132,492 @@ type NetworkState struct {
 	Mode              string
 	Gateway           string
 	GatewayMask       string
+	Gateway6          string
+	Gateway6Mask      string
+	IPv6NAT           bool
+	Pools             []PoolState
 	FlatBindInterface string
+	VlanID            int
+	VlanInterface     string
+	VxlanID           int
+	VxlanInterface    string
+	VxlanPeers        []string
+	VxlanGroup        string
+	VxlanPort         int
+	Internal          bool
+	AllowNetworks     []string
+	// DisableICC is kept the other way round from bridge.enable_icc so that
+	// networks saved before it existed keep ICC
+	DisableICC bool
 }
 
 func (d *Driver) CreateNetwork(r *dknet.CreateNetworkRequest) error {
 	log.Debugf("Create network request: %+v", r)
+	d.opLock.RLock()
+	defer d.opLock.RUnlock()
+	return d.createNetwork(r, false)
+}
 
-	bridgeName, err := getBridgeName(r)
-	if err != nil {
-		return err
+// createNetwork is CreateNetwork without opLock, which the caller holds.
+// reuse lets Reconcile take back the bridge a lost network left behind.
+func (d *Driver) createNetwork(r *dknet.CreateNetworkRequest, reuse bool) error {
+	unlock := d.netLock(r.NetworkID)
+	defer unlock()
+
+	if _, err := d.getNetwork(r.NetworkID); err == nil {
+		return fmt.Errorf("network %s already exists", r.NetworkID)
 	}
 
-	mtu, err := getBridgeMTU(r)
+	config, err := parseNetworkConfig(r.Options)
 	if err != nil {
 		return err
 	}
 
-	mode, err := getBridgeMode(r)
+	bridgeName := getBridgeName(r.NetworkID, config)
+	mtu := config.MTU
+
+	mode, err := getBridgeMode(config)
 	if err != nil {
 		return err
 	}
 
-	gateway, mask, err := getGatewayIP(r)
+	pools, err := getPools(r)
 	if err != nil {
 		return err
 	}
+	gateway, mask := firstGateway(pools, false)
+	if gateway == "" {
+		return fmt.Errorf("No gateway IP found")
+	}
+	gateway6, mask6 := firstGateway(pools, true)
 
-	bindInterface, err := getBindInterface(r)
+	ipv6NAT := config.IPv6NAT
+	if gateway6 != "" && mode == modeRouted {
+		return fmt.Errorf("IPv6 is not supported in %s mode", modeRouted)
+	}
+	if ipv6NAT && (gateway6 == "" || (mode != modeNAT && mode != modeVxlan)) {
+		return fmt.Errorf("%s needs an IPv6 subnet in %s or %s mode", ipv6NATOption, modeNAT, modeVxlan)
+	}
+
+	bindInterface, err := getBindInterface(config)
 	if err != nil {
 		return err
 	}
 
+	vlanID := config.Vlan
+	vlanInterface := ""
+	if vlanID != 0 {
+		if bindInterface == "" {
+			return fmt.Errorf("%s needs %s", vlanOption, bindInterfaceOption)
+		}
+		vlanInterface = vlanInterfaceName(bindInterface, vlanID, r.NetworkID)
+	}
+
 	ns := &NetworkState{
 		BridgeName:        bridgeName,
 		MTU:               mtu,
 		Mode:              mode,
 		Gateway:           gateway,
 		GatewayMask:       mask,
+		Gateway6:          gateway6,
+		Gateway6Mask:      mask6,
+		IPv6NAT:           ipv6NAT,
+		Pools:             pools,
 		FlatBindInterface: bindInterface,
+		VlanID:            vlanID,
+		VlanInterface:     vlanInterface,
+	}
+	// docker network create --internal also makes a network internal
+	dockerInternal, _ := r.Options[dockerInternalOption].(bool)
+	if config.Internal || dockerInternal {
+		if mode != modeNAT && mode != modeVxlan {
+			return fmt.Errorf("%s mode networks can not be internal", mode)
+		}
+		ns.Internal = true
+	}
+	for _, id := range config.AllowNetworks {
+		// Short IDs are fine, anything shorter could match by chance
+		if len(id) < 12 {
+			return fmt.Errorf("%s: %s is not a network ID", allowNetworksOption, id)
+		}
+	}
+	ns.AllowNetworks = config.AllowNetworks
+	if !config.EnableICC {
+		if mode == modeRouted || mode == modeIPVlan {
+			return fmt.Errorf("%s can not be turned off in %s mode", enableICCOption, mode)
+		}
+		ns.DisableICC = true
+	}
+	if mtu == 0 {
+		ns.MTU = detectMTU(ns)
+		log.Debugf("Using MTU [ %d ] for network [ %s ]", ns.MTU, r.NetworkID)
+	}
+	if isChildMode(mode) {
+		// Containers hang off the bind interface, there is no bridge
+		ns.BridgeName = ""
+	}
+	if mode == modeVxlan {
+		if vlanID != 0 {
+			return fmt.Errorf("%s can not be used in %s mode", vlanOption, modeVxlan)
+		}
+		vxlan, err := getVxlanConfig(config)
+		if err != nil {
+			return err
+		}
+		ns.VxlanID = vxlan.id
+		ns.VxlanInterface = vxlanPrefix + truncateID(r.NetworkID)
+		ns.VxlanPeers = vxlan.peers
+		ns.VxlanGroup = vxlan.group
+		ns.VxlanPort = vxlan.port
+	}
+	if ns, err = d.shareNetwork(r.NetworkID, ns); err != nil {
+		return err
+	}
+	if err := d.addNetwork(r.NetworkID, ns); err != nil {
+		return err
 	}
-	d.networks[r.NetworkID] = ns
 
 	log.Debugf("Initializing bridge for network %s", r.NetworkID)
-	if err := d.initBridge(r.NetworkID); err != nil {
-		delete(d.networks, r.NetworkID)
+	if err := d.initBridge(r.NetworkID, reuse); err != nil {
+		d.setNetwork(r.NetworkID, nil)
 		return err
 	}
+	d.saveState(r.NetworkID)
 	return nil
 }
 
 func (d *Driver) DeleteNetwork(r *dknet.DeleteNetworkRequest) error {
 	log.Debugf("Delete network request: %+v", r)
-	bridgeName := d.networks[r.NetworkID].BridgeName
+	d.opLock.RLock()
+	defer d.opLock.RUnlock()
+	return d.deleteNetwork(r)
+}
+
+// deleteNetwork is DeleteNetwork without opLock, which the caller holds
+func (d *Driver) deleteNetwork(r *dknet.DeleteNetworkRequest) error {
+	unlock := d.netLock(r.NetworkID)
+	defer unlock()
 
-	// Delete NAT rules for bridge
-	gatewayIP := d.networks[r.NetworkID].Gateway + "/" + d.networks[r.NetworkID].GatewayMask
-	if err := delNatOut(gatewayIP, bridgeName); err != nil {
-		log.Fatalf("Could not del NAT rules for bridge %s", bridgeName)
+	network, err := d.getNetwork(r.NetworkID)
+	if err != nil {
 		return err
 	}
+	bridgeName := network.BridgeName
+
+	switch network.Mode {
+	case modeNAT, modeVxlan:
+		if network.IPv6NAT {
+			for _, pool := range network.pools() {
+				if !pool.ipv6() || pool.Gateway == "" {
+					continue
+				}
+				if err := delNat66Out(pool.gatewayCIDR(), bridgeName); err != nil {
+					log.Errorf("Could not del NAT66 rules for bridge %s", bridgeName)
+					return err
+				}
+			}
+		}
+		if network.Internal {
+			if err := delInternalRules(bridgeName, network.Gateway6 != ""); err != nil {
+				log.Errorf("Could not del isolation rules for bridge %s", bridgeName)
+				return err
+			}
+			break
+		}
+		// Delete NAT rules for bridge
+		for _, pool := range network.pools() {
+			if pool.ipv6() || pool.Gateway == "" {
+				continue
+			}
+			if err := delNatOut(pool.gatewayCIDR(), bridgeName); err != nil {
+				log.Errorf("Could not del NAT rules for bridge %s", bridgeName)
+				return err
+			}
+		}
+	case modeFlat:
+		if network.VlanID != 0 {
+			// The vlan subinterface goes away with the bridge
+			break
+		}
+		// Give the host its addresses back before the bridge goes away,
+		// without the auxiliary ones which belong to the network
+		delHostAddresses(network)
+		if err := detachUplink(bridgeName, network.FlatBindInterface, true); err != nil {
+			log.Errorf("Could not detach [ %s ] from bridge [ %s ]: %s", network.FlatBindInterface, bridgeName, err)
+			return err
+		}
+	}
 
 	log.Debugf("Deleting Bridge %s", bridgeName)
-	if err := deleteBridge(bridgeName); err != nil {
+	if err := deleteBridge(network); err != nil {
 		log.Errorf("Deleting bridge %s failed: %s", bridgeName, err)
 		return err
 	}
-	delete(d.networks, r.NetworkID)
+	d.setNetwork(r.NetworkID, nil)
+	d.saveState(r.NetworkID)
+	if d.cluster != nil {
+		if err := d.cluster.Delete(networkKeyPrefix + r.NetworkID); err != nil {
+			log.Warnf("Could not delete network [ %s ] from the cluster store: %s", r.NetworkID, err)
+		}
+	}
 	return nil
 }
 
 func (d *Driver) CreateEndpoint(r *dknet.CreateEndpointRequest) error {
+	_, err := d.CreateEndpointResponse(r)
+	return err
+}
+
+// CreateEndpointResponse creates an endpoint and tells docker the MAC the
+// driver gave it
+func (d *Driver) CreateEndpointResponse(r *dknet.CreateEndpointRequest) (*dknet.CreateEndpointResponse, error) {
 	log.Debugf("Create endpoint request: %+v", r)
+	mac, err := d.createEndpoint(r)
+	if err != nil {
+		return nil, err
+	}
+	res := &dknet.CreateEndpointResponse{}
+	// Docker refuses an answer that changes a MAC it asked for
+	if mac != "" && r.Interface.MacAddress == "" {
+		res.Interface = &dknet.EndpointInterface{MacAddress: mac}
+	}
+	return res, nil
+}
+
+// createEndpoint sets up an endpoint and returns the MAC it got, empty when
+// the driver has no say in it
+func (d *Driver) createEndpoint(r *dknet.CreateEndpointRequest) (string, error) {
+	unlock := d.lockNetwork(r.NetworkID)
+	defer unlock()
+
+	network, err := d.getNetwork(r.NetworkID)
+	if err != nil {
+		return "", err
+	}
+	config, err := parseEndpointConfig(r.Options)
+	if err != nil {
+		return "", err
+	}
+	fipRequest, err := getFipRequest(config)
+	if err != nil {
+		return "", err
+	}
+
+	bindings, err := getPortBindings(r.Options)
+	if err != nil {
+		return "", err
+	}
+	exposed, err := getExposedPorts(r.Options)
+	if err != nil {
+		return "", err
+	}
+
+	if !supportsFips(network) {
+		if fipRequest != "" && fipRequest != fipNone {
+			return "", fmt.Errorf("network %s does not support floating IPs", r.NetworkID)
+		}
+		if len(bindings) > 0 {
+			return "", fmt.Errorf("network %s does not support published ports", r.NetworkID)
+		}
+		fipRequest = fipNone
+	}
+
+	lipStr := strings.Split(r.Interface.Address, "/")[0]
+	lip6Str := strings.Split(r.Interface.AddressIPv6, "/")[0]
+	mac, err := endpointMac(r.Interface.MacAddress, lipStr)
+	if err != nil {
+		return "", err
+	}
+	if network.Mode == modeIPVlan {
+		// ipvlan links share the MAC of their parent
+		mac = ""
+	}
+	ep := &EndpointState{
+		NetworkID:    r.NetworkID,
+		Lip:          lipStr,
+		Lip6:         lip6Str,
+		Mac:          mac,
+		FipRequest:   fipRequest,
+		ExposedPorts: exposed,
+	}
+	if err := d.reservePorts(r.EndpointID, ep, bindings); err != nil {
+		return "", err
+	}
+	if isChildMode(network.Mode) {
+		if err := createChildLink(network, childLinkName(truncateID(r.EndpointID)), mac); err != nil {
+			log.Errorf("Could not create link for endpoint [ %s ]: %s", r.EndpointID, err)
+			d.setEndpoint(r.EndpointID, nil)
+			return "", err
+		}
+		d.saveState(r.NetworkID)
+		return mac, nil
+	}
+
 	localVethPair := vethPair(truncateID(r.EndpointID))
+	// Both ends get the MTU of the network
+	localVethPair.MTU = network.MTU
 	if err := netlink.LinkAdd(localVethPair); err != nil {
 		log.Errorf("failed to create the veth pair named: [ %v ] error: [ %s ] ", localVethPair, err)
-		return err
+		d.setEndpoint(r.EndpointID, nil)
+		return "", err
+	}
+	// Don't leave the veth pair behind if the endpoint can't be set up
+	cleanup := func() {
+		if network.Mode == modeRouted {
+			delEndpointRoute(network, localVethPair.Name, lipStr)
+		}
+		if err := netlink.LinkDel(localVethPair); err != nil {
+			log.Warnf("Could not delete veth [ %s ]: %s", localVethPair.Name, err)
+		}
+		d.setEndpoint(r.EndpointID, nil)
+	}
+	if err := setLinkMac(localVethPair.PeerName, mac); err != nil {
+		log.Errorf("Could not set the MAC of veth [ %s ]: %s", localVethPair.PeerName, err)
+		cleanup()
+		return "", err
 	}
 	// Bring the veth pair up
-	err := netlink.LinkSetUp(localVethPair)
+	err = netlink.LinkSetUp(localVethPair)
 	if err != nil {
 		log.Warnf("Error enabling  Veth local iface: [ %v ]", localVethPair)
-		return err
+		cleanup()
+		return "", err
 	}
 
-	bridgeName := d.networks[r.NetworkID].BridgeName
-	link, _ := netlink.LinkByName(bridgeName)
+	bridgeName := network.BridgeName
+	if network.Mode == modeRouted {
+		// Routed endpoints stay off the bridge
+		if err := addEndpointRoute(network, localVethPair.Name, lipStr); err != nil {
+			log.Errorf("Could not route [ %s ] via veth [ %s ]: %s", lipStr, localVethPair.Name, err)
+			cleanup()
+			return "", err
+		}
+	} else {
+		link, err := netlink.LinkByName(bridgeName)
+		if err != nil {
+			log.Errorf("bridge [ %s ] not found: %s", bridgeName, err)
+			cleanup()
+			return "", err
+		}
+
+		bridge := netlink.Bridge{}
+		bridge.LinkAttrs = *(link.Attrs())
+
+		if err := netlink.LinkSetMaster(localVethPair, &bridge); err != nil {
+			log.Errorf("error attaching veth [ %s ] to bridge [ %s ]", localVethPair.Name, bridgeName)
+			cleanup()
+			return "", err
+		}
+
+		log.Infof("Attached veth [ %s ] to bridge [ %s ]", localVethPair.Name, bridgeName)
+	}
 
-	bridge := netlink.Bridge{}
-	bridge.LinkAttrs = *(link.Attrs())
+	// Without an explicit request the container labels decide, which can
+	// only be looked up once the endpoint has joined its container
+	if fipRequest != "" {
+		if err := d.assignFip(r.EndpointID, fipRequest, bridgeName); err != nil {
+			cleanup()
+			return "", err
+		}
+	}
+	d.saveState(r.NetworkID)
+	return mac, nil
+}
 
-	if err := netlink.LinkSetMaster(localVethPair, &bridge); err != nil {
-		log.Errorf("error attaching veth [ %s ] to bridge [ %s ]", localVethPair.Name, bridgeName)
+// assignFip gives the endpoint the floating IP asked for in request
+func (d *Driver) assignFip(endpointID string, request string, bridgeName string) error {
+	var fip net.IP
+	switch request {
+	case fipNone:
+		log.Debugf("Endpoint [ %s ] opted out of a floating ip", endpointID)
+		return nil
+	case fipAuto, "":
+		if d.fips.Empty() {
+			return nil
+		}
+		ip, err := d.fips.Allocate(endpointID)
+		if err != nil {
+			log.Errorf("Could not allocate a floating ip for endpoint %s: %s", endpointID, err)
+			return err
+		}
+		fip = ip
+	default:
+		fip = net.ParseIP(request)
+		if fip == nil {
+			return fmt.Errorf("%s is not a valid floating ip", request)
+		}
+		if d.ipam.Allocated(fip) {
+			return fmt.Errorf("floating ip %s is the address of a container", fip)
+		}
+		if err := d.fips.Request(endpointID, fip); err != nil {
+			return err
+		}
+	}
+	if err := d.setupFip(endpointID, fip.String(), bridgeName); err != nil {
+		d.fips.Release(fip.String())
 		return err
 	}
+	return nil
+}
 
-	log.Infof("Attached veth [ %s ] to bridge [ %s ]", localVethPair.Name, bridgeName)
+// completeJoin finds the container that joined the endpoint, points its
+// default route at the network gateway and gives it the floating IP named in its
+// labels when the endpoint options did not ask for one
+func (d *Driver) completeJoin(networkID, endpointID, sandboxKey string) {
+	var container *containerInfo
+	var err error
+	for i := 0; i < containerLookupRetries; i++ {
+		if container, err = d.containerForEndpoint(networkID, endpointID, sandboxKey); err == nil {
+			break
+		}
+		log.Debugf("Container of endpoint [ %s ] not found yet, retrying", endpointID)
+		time.Sleep(time.Second)
+	}
 
+	unlock := d.lockNetwork(networkID)
+	defer unlock()
+	network, err := d.getNetwork(networkID)
+	if err != nil {
+		return
+	}
+	ep, err := d.getEndpoint(endpointID)
+	if err != nil || ep.SandboxKey != sandboxKey {
+		log.Debugf("Endpoint [ %s ] left before its join completed", endpointID)
+		return
+	}
+
+	if container == nil {
+		log.Errorf("Could not find the container of endpoint [ %s ]", endpointID)
+	} else {
+		ep.Container = container.Id
+		log.Infof("Endpoint [ %s ] belongs to container [ %s ]", endpointID, container.Id)
+	}
+
+	gw, err := setSandboxGateway(sandboxKey, network.gatewayFor(ep.Lip))
+	if err != nil {
+		log.Errorf("Could not update the default gateway of endpoint [ %s ]: %s", endpointID, err)
+	}
+	ep.OriginGateway = gw
+
+	if ep.FipRequest != "" {
+		d.saveState(networkID)
+		return
+	}
+	request := ""
+	if container != nil {
+		request = container.Config.Labels[fipOption]
+	}
+	if err := d.assignFip(endpointID, request, network.BridgeName); err != nil {
+		log.Errorf("Could not assign a floating ip to endpoint [ %s ]: %s", endpointID, err)
+	}
+	d.saveState(networkID)
+}
+
+// setupFip adds the floating IP to the interface routing towards it and
+// DNATs it to the endpoint's local address
+func (d *Driver) setupFip(endpointID string, fipStr string, bridgeName string) error {
 	// Add floating IP to GW interface
-	fip := "10.0.2.200/32"
+	fip := fipStr + "/32"
 	fipNet, err := netlink.ParseIPNet(fip)
 	if err != nil {
 		return err
@@ -171,79 +631,250 @@ func (d *Driver) CreateEndpoint(r *dknet.CreateEndpointRequest) error {
 	if err != nil {
 		return err
 	}
-	setInterfaceIP(intf.Name, fip)
+	if err := setInterfaceIP(intf.Name, fip); err != nil {
+		log.Errorf("Could not add floating ip %s to interface %s: %s", fip, intf.Name, err)
+		return err
+	}
 
 	// Add DNAT rules for floating IP
-	fipStr := strings.Split(fip, "/")[0]
-	lipStr := strings.Split(r.Interface.Address, "/")[0]
-	d.endpoints[r.EndpointID] = &EndpointState{
-		Fip: fipStr,
-		FipIfName: intf.Name,
-		Lip: lipStr,
-		Container: "1f9974015e01",
+	ep, err := d.getEndpoint(endpointID)
+	if err != nil {
+		return err
 	}
+	if err = addFipDnat(fipStr, ep.Lip, bridgeName); err != nil {
+		log.Errorf("Could not set NAT rules for floating ip %s: %s", fip, err)
+		delInterfaceIP(intf.Name, fip)
+		return err
+	}
+	ep.Fip = fipStr
+	ep.FipIfName = intf.Name
+	return nil
+}
 
-	if err = addFipDnat(fipStr, lipStr, bridgeName); err != nil {
-		log.Fatalf("Could not set NAT rules for floating ip %s", fip)
-		log.Fatalf("%s", err)
+// teardownFip undoes setupFip. FipIfName is cleared once the address and
+// its DNAT rule are gone, so that it is only done once.
+func teardownFip(ep *EndpointState, bridgeName string) error {
+	if ep.Fip == "" || ep.FipIfName == "" {
+		return nil
+	}
+	if err := delFipDnat(ep.Fip, ep.Lip, bridgeName); err != nil {
+		log.Errorf("Delete DNAT rule failed!")
 		return err
 	}
+	// Delete floating ip on interface, an interface that is gone took the
+	// address with it
+	if err := delInterfaceIP(ep.FipIfName, ep.Fip+"/32"); err != nil {
+		log.Warnf("%s", err)
+	}
+	ep.FipIfName = ""
 	return nil
 }
 
 func (d *Driver) DeleteEndpoint(r *dknet.DeleteEndpointRequest) error {
 	log.Debugf("Delete endpoint request: %+v", r)
-	delete(d.endpoints, r.EndpointID)
+	d.opLock.RLock()
+	defer d.opLock.RUnlock()
+	return d.deleteEndpoint(r)
+}
+
+// deleteEndpoint is DeleteEndpoint without opLock, which the caller holds
+func (d *Driver) deleteEndpoint(r *dknet.DeleteEndpointRequest) error {
+	unlock := d.netLock(r.NetworkID)
+	defer unlock()
+
+	// Docker deletes an endpoint without a leave when its container failed
+	// to start, whatever Leave would have undone is still there
+	network, err := d.getNetwork(r.NetworkID)
+	if ep, epErr := d.getEndpoint(r.EndpointID); epErr == nil {
+		if err == nil {
+			if err := teardownFip(ep, network.BridgeName); err != nil {
+				log.Warnf("Could not remove floating ip [ %s ] of endpoint [ %s ]: %s", ep.Fip, r.EndpointID, err)
+			}
+			if network.Mode == modeRouted {
+				delEndpointRoute(network, vethPair(truncateID(r.EndpointID)).Name, ep.Lip)
+			}
+		}
+		if ep.Fip != "" {
+			d.fips.Release(ep.Fip)
+		}
+	}
+	// A child link that never joined is still in the host namespace, as is
+	// the veth pair of an endpoint that never joined
+	linkName := vethPair(truncateID(r.EndpointID)).Name
+	if err == nil && isChildMode(network.Mode) {
+		linkName = childLinkName(truncateID(r.EndpointID))
+	}
+	if err := deleteLink(linkName); err != nil {
+		log.Warnf("Could not delete link of endpoint [ %s ]: %s", r.EndpointID, err)
+	}
+	d.setEndpoint(r.EndpointID, nil)
+	d.saveState(r.NetworkID)
 	return nil
 }
 
+// EndpointInfo reports what was programmed for an endpoint, docker shows it
+// in network inspect
 func (d *Driver) EndpointInfo(r *dknet.InfoRequest) (*dknet.InfoResponse, error) {
-	res := &dknet.InfoResponse{
-		Value: make(map[string]string),
+	log.Debugf("Endpoint info request: %+v", r)
+	unlock := d.lockNetwork(r.NetworkID)
+	defer unlock()
+
+	network, err := d.getNetwork(r.NetworkID)
+	if err != nil {
+		return nil, err
 	}
-	return res, nil
+	ep, err := d.getEndpoint(r.EndpointID)
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]string{
+		"mode": network.Mode,
+		"mtu":  strconv.Itoa(network.MTU),
+	}
+	set := func(key, value string) {
+		if value != "" {
+			info[key] = value
+		}
+	}
+	set("bridge", network.BridgeName)
+	set("mac", ep.Mac)
+	set("fip", ep.Fip)
+	set("fip_interface", ep.FipIfName)
+	set("origin_gateway", ep.OriginGateway)
+	set("container", ep.Container)
+	set("ports", formatPorts(ep.Ports))
+	set("exposed_ports", formatExposedPorts(ep.ExposedPorts))
+
+	if isChildMode(network.Mode) {
+		// The child link is in the container, its counters are not
+		// visible from here
+		set("interface", childLinkName(truncateID(r.EndpointID)))
+		return &dknet.InfoResponse{Value: info}, nil
+	}
+	vethName := vethPair(truncateID(r.EndpointID)).Name
+	set("veth", vethName)
+	if link, err := netlink.LinkByName(vethName); err == nil && link.Attrs().Statistics != nil {
+		// Counters of the host end, what it receives the container sent
+		stats := link.Attrs().Statistics
+		info["rx_bytes"] = strconv.FormatUint(uint64(stats.RxBytes), 10)
+		info["tx_bytes"] = strconv.FormatUint(uint64(stats.TxBytes), 10)
+		info["rx_packets"] = strconv.FormatUint(uint64(stats.RxPackets), 10)
+		info["tx_packets"] = strconv.FormatUint(uint64(stats.TxPackets), 10)
+		info["rx_dropped"] = strconv.FormatUint(uint64(stats.RxDropped), 10)
+		info["tx_dropped"] = strconv.FormatUint(uint64(stats.TxDropped), 10)
+		info["rx_errors"] = strconv.FormatUint(uint64(stats.RxErrors), 10)
+		info["tx_errors"] = strconv.FormatUint(uint64(stats.TxErrors), 10)
+	}
+	return &dknet.InfoResponse{Value: info}, nil
 }
 
 func (d *Driver) Join(r *dknet.JoinRequest) (*dknet.JoinResponse, error) {
+	unlock := d.lockNetwork(r.NetworkID)
+	defer unlock()
+
+	network, err := d.getNetwork(r.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+	ep, err := d.getEndpoint(r.EndpointID)
+	if err != nil {
+		return nil, err
+	}
 	// create and attach local name to the bridge
 	localVethPair := vethPair(truncateID(r.EndpointID))
 
-	gw, err := updateDefaultGW4Container(d.endpoints[r.EndpointID].Container, d.endpoints[r.EndpointID].Lip)
-	if err != nil {
+	srcName := localVethPair.PeerName
+	if isChildMode(network.Mode) {
+		srcName = childLinkName(truncateID(r.EndpointID))
+	}
+
+	// Ports published after the endpoint was created come with the join
+	if len(ep.Ports) == 0 && supportsFips(network) {
+		bindings, err := getPortBindings(r.Options)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.reservePorts(r.EndpointID, ep, bindings); err != nil {
+			return nil, err
+		}
+	}
+	if err := publishPorts(ep, network.BridgeName); err != nil {
 		return nil, err
 	}
-	d.endpoints[r.EndpointID].OriginGateway = gw
+
+	ep.SandboxKey = r.SandboxKey
+	d.saveState(r.NetworkID)
 	// SrcName gets renamed to DstPrefix + ID on the container iface
 	res := &dknet.JoinResponse{
 		InterfaceName: dknet.InterfaceName{
-			SrcName:   localVethPair.PeerName,
+			SrcName:   srcName,
 			DstPrefix: containerEthName,
 		},
-		Gateway: d.networks[r.NetworkID].Gateway,
+		Gateway: network.gatewayFor(ep.Lip),
+	}
+	if ep.Lip6 != "" {
+		res.GatewayIPv6 = network.gatewayFor(ep.Lip6)
 	}
+	// Docker holds the container lock until the join completes, so the
+	// container can only be inspected once we have answered
+	go d.completeJoin(r.NetworkID, r.EndpointID, r.SandboxKey)
 	log.Debugf("Join endpoint %s:%s to %s", r.NetworkID, r.EndpointID, r.SandboxKey)
 	return res, nil
 }
 
 func (d *Driver) Leave(r *dknet.LeaveRequest) error {
 	log.Debugf("Leave request: %+v", r)
+	d.opLock.RLock()
+	defer d.opLock.RUnlock()
+	return d.leave(r)
+}
+
+// leave is Leave without opLock, which the caller holds
+func (d *Driver) leave(r *dknet.LeaveRequest) error {
+	unlock := d.netLock(r.NetworkID)
+	defer unlock()
+
 	localVethPair := vethPair(truncateID(r.EndpointID))
-	portID := fmt.Sprintf(brPortPrefix + truncateID(r.EndpointID))
-	bridgeName := d.networks[r.NetworkID].BridgeName
+	portID := brPortPrefix + truncateID(r.EndpointID)
+	network, err := d.getNetwork(r.NetworkID)
+	if err != nil {
+		return err
+	}
+	ep, err := d.getEndpoint(r.EndpointID)
+	if err != nil {
+		return err
+	}
+	bridgeName := network.BridgeName
 
-	updateDefaultGW4Container(d.endpoints[r.EndpointID].Container, d.endpoints[r.EndpointID].OriginGateway)
+	if ep.OriginGateway != "" {
+		if _, err := setSandboxGateway(ep.SandboxKey, ep.OriginGateway); err != nil {
+			log.Warnf("Could not restore the default gateway of endpoint [ %s ]: %s", r.EndpointID, err)
+		}
+	}
 
-	// Delete DNAT for floating ip
-	fip := d.endpoints[r.EndpointID].Fip
-	lip := d.endpoints[r.EndpointID].Lip
-	if err:= delFipDnat(fip, lip, bridgeName); err != nil {
-		log.Errorf("Delete DNAT rule failed!")
+	if isChildMode(network.Mode) {
+		// Docker moves the link back to the host when the sandbox goes
+		childName := childLinkName(truncateID(r.EndpointID))
+		if err := deleteLink(childName); err != nil {
+			log.Errorf("unable to delete link [ %s ] on leave: %s", childName, err)
+		}
+		log.Debugf("Leave %s:%s", r.NetworkID, r.EndpointID)
+		ep.SandboxKey = ""
+		d.saveState(r.NetworkID)
+		return nil
+	}
+
+	unpublishPorts(ep, bridgeName)
+
+	// Delete DNAT for floating ip, the address itself stays with the
+	// endpoint until it is deleted
+	if err := teardownFip(ep, bridgeName); err != nil {
 		return err
 	}
 
-	// Delete floating ip on interface
-	fipIfName := d.endpoints[r.EndpointID].FipIfName
-	delInterfaceIP(fipIfName, fip+"/32")
+	if network.Mode == modeRouted {
+		delEndpointRoute(network, localVethPair.Name, ep.Lip)
+	}
 
 	//
 	if err:= netlink.LinkSetNoMaster(localVethPair); err != nil {
@@ -256,21 +887,283 @@ func (d *Driver) Leave(r *dknet.LeaveRequest) error {
 	}
 	log.Infof("Deleted port [ %s ] from bridge [ %s ]", portID, bridgeName)
 	log.Debugf("Leave %s:%s", r.NetworkID, r.EndpointID)
+	ep.SandboxKey = ""
+	d.saveState(r.NetworkID)
 	return nil
 }
 
-func NewDriver() (*Driver, error) {
+// lockNetwork serializes the requests for one network and returns the
+// function that releases the lock. Locks are kept for the lifetime of the
+// plugin, they are cheap and a request may still be waiting on one when its
+// network goes away.
+func (d *Driver) lockNetwork(id string) func() {
+	d.opLock.RLock()
+	unlock := d.netLock(id)
+	return func() {
+		unlock()
+		d.opLock.RUnlock()
+	}
+}
+
+// netLock takes the lock of a network alone, for callers that already hold
+// opLock
+func (d *Driver) netLock(id string) func() {
+	d.mu.Lock()
+	l, ok := d.netLocks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		d.netLocks[id] = l
+	}
+	d.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func (d *Driver) getNetwork(id string) (*NetworkState, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	network, ok := d.networks[id]
+	if !ok {
+		return nil, fmt.Errorf("network %s not found", id)
+	}
+	return network, nil
+}
+
+// supportsFips tells whether endpoints of a network can get floating IPs
+// and publish ports. Both are DNATed by the host, which can't reach a child
+// link, and would give an internal network a way out. The DNAT rules skip
+// what comes in on the bridge, which is all the traffic of a bridge holding
+// the host uplink.
+func supportsFips(network *NetworkState) bool {
+	return !isChildMode(network.Mode) && !network.Internal && !holdsUplink(network)
+}
+
+// holdsUplink tells whether the bridge of a network has the host NIC
+// enslaved, a flat network without a VLAN
+func holdsUplink(network *NetworkState) bool {
+	return network.Mode == modeFlat && network.VlanID == 0
+}
+
+// addNetwork adds a new network to the state after checking that it does
+// not clash with the ones already there
+func (d *Driver) addNetwork(id string, ns *NetworkState) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for otherID, other := range d.networks {
+		if ns.VlanID != 0 && other.VlanID == ns.VlanID && other.FlatBindInterface == ns.FlatBindInterface {
+			return fmt.Errorf("vlan %d on %s is already used by network %s", ns.VlanID, ns.FlatBindInterface, otherID)
+		}
+		if ns.BridgeName != "" && other.BridgeName == ns.BridgeName {
+			return fmt.Errorf("bridge %s is already used by network %s", ns.BridgeName, otherID)
+		}
+		if ns.VxlanID != 0 && other.VxlanID == ns.VxlanID {
+			return fmt.Errorf("vni %d is already used by network %s", ns.VxlanID, otherID)
+		}
+	}
+	d.networks[id] = ns
+	return nil
+}
+
+// shareNetwork publishes the definition of a network in the cluster store,
+// or returns the one published by the host that created the network first,
+// so that every host sets it up the same way
+func (d *Driver) shareNetwork(id string, ns *NetworkState) (*NetworkState, error) {
+	if d.cluster == nil {
+		return ns, nil
+	}
+	data, err := json.Marshal(ns)
+	if err != nil {
+		return nil, err
+	}
+	key := networkKeyPrefix + id
+	err = d.cluster.PutIfAbsent(key, data)
+	if err == nil {
+		log.Debugf("Published network [ %s ] to the cluster store", id)
+		return ns, nil
+	}
+	if err != errKeyExists {
+		return nil, fmt.Errorf("could not publish network %s: %s", id, err)
+	}
+	data, err = d.cluster.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not read network %s from the cluster store: %s", id, err)
+	}
+	shared := &NetworkState{}
+	if err := json.Unmarshal(data, shared); err != nil {
+		return nil, fmt.Errorf("invalid definition of network %s in the cluster store: %s", id, err)
+	}
+	log.Debugf("Using the definition of network [ %s ] from the cluster store", id)
+	return shared, nil
+}
+
+// Scope tells docker whether networks are local to the host or span the
+// cluster
+func (d *Driver) Scope() string {
+	return d.scope
+}
+
+// setNetwork adds a network to the state, or removes it when ns is nil
+func (d *Driver) setNetwork(id string, ns *NetworkState) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if ns == nil {
+		delete(d.networks, id)
+		return
+	}
+	d.networks[id] = ns
+}
+
+func (d *Driver) getEndpoint(id string) (*EndpointState, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ep, ok := d.endpoints[id]
+	if !ok {
+		return nil, fmt.Errorf("endpoint %s not found", id)
+	}
+	return ep, nil
+}
+
+// setEndpoint adds an endpoint to the state, or removes it when ep is nil
+func (d *Driver) setEndpoint(id string, ep *EndpointState) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if ep == nil {
+		delete(d.endpoints, id)
+		return
+	}
+	d.endpoints[id] = ep
+}
+
+func (d *Driver) networkIDs() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ids := []string{}
+	for id := range d.networks {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (d *Driver) endpointIDs(networkID string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ids := []string{}
+	for id, ep := range d.endpoints {
+		if ep.NetworkID == networkID {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// saveState writes the state of a network and its endpoints to disk. The
+// caller must hold the network lock; other networks are written from the
+// copy taken when they were last saved. Failures are only logged, the
+// kernel has already been changed at this point.
+func (d *Driver) saveState(networkID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.saved.update(networkID, d.networks, d.endpoints)
+	if err := d.store.save(d.saved); err != nil {
+		log.Errorf("Could not save driver state: %s", err)
+	}
+}
+
+// Config holds the settings the plugin was started with
+type Config struct {
+	// FipPool is a comma separated list of CIDRs and IP ranges that
+	// floating IPs are allocated from
+	FipPool string
+	// StateDir is where the driver state is kept across restarts
+	StateDir string
+	// DriverName is the name docker knows the plugin by
+	DriverName string
+	// Scope is "local", the default, or "global" for networks that span
+	// the hosts sharing ClusterStore
+	Scope string
+	// ClusterStore is the URL of the store network definitions, floating
+	// IP claims and global address pools are shared through, such as
+	// file:///mnt/shared/bridge
+	ClusterStore string
+	// IpamPools is a comma separated list of CIDRs the IPAM driver gives
+	// to networks created without a subnet
+	IpamPools string
+}
+
+func NewDriver(config *Config) (*Driver, error) {
+	fips, err := newFipPool(config.FipPool)
+	if err != nil {
+		return nil, err
+	}
+
+	scope := config.Scope
+	if scope == "" {
+		scope = scopeLocal
+	}
+	var cluster kvStore
+	switch scope {
+	case scopeLocal:
+	case scopeGlobal:
+		if config.ClusterStore == "" {
+			return nil, fmt.Errorf("%s scope needs a cluster store", scopeGlobal)
+		}
+	default:
+		return nil, fmt.Errorf("invalid scope %s, must be %s or %s", scope, scopeLocal, scopeGlobal)
+	}
+	if config.ClusterStore != "" {
+		if cluster, err = newKVStore(config.ClusterStore); err != nil {
+			return nil, err
+		}
+		fips.claims = cluster
+	}
+
+	store, err := newStateStore(config.StateDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not open state directory %s: %s", config.StateDir, err)
+	}
+	local, err := newFileStore(config.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	ipam, err := newIpam(local, cluster, config.IpamPools, fips)
+	if err != nil {
+		return nil, err
+	}
+	state, err := store.load()
+	if err != nil {
+		return nil, fmt.Errorf("could not load driver state: %s", err)
+	}
+
+	// Floating IPs held before the restart stay with their endpoints
+	for id, ep := range state.Endpoints {
+		if ep.Fip == "" {
+			continue
+		}
+		if err := fips.Request(id, net.ParseIP(ep.Fip)); err != nil {
+			log.Warnf("Could not restore floating ip [ %s ] of endpoint [ %s ]: %s", ep.Fip, id, err)
+		}
+	}
+
 	docker, err := dockerclient.NewDockerClient("unix:///var/run/docker.sock", nil)
 	if err != nil {
 		return nil, fmt.Errorf("could not connect to docker: %s", err)
 	}
+	docker.HTTPClient.Timeout = dockerAPITimeout
 
 	d := &Driver{
 		dockerer: dockerer{
 			client: docker,
 		},
-		networks: make(map[string]*NetworkState),
-		endpoints: make(map[string]*EndpointState),
+		ipam:      ipam,
+		name:      config.DriverName,
+		scope:     scope,
+		cluster:   cluster,
+		netLocks:  make(map[string]*sync.Mutex),
+		networks:  state.Networks,
+		endpoints: state.Endpoints,
+		fips:      fips,
+		store:     store,
+		saved:     state.copy(),
 	}
 
 	return d, nil
@@ -294,86 +1187,82 @@ func interfaceUp(name string) error {
 	return netlink.LinkSetUp(iface)
 }
 
+// endpointMac returns the MAC docker asked for, or one derived from the
+// endpoint address so that it stays the same when the container comes back
+func endpointMac(requested string, lip string) (string, error) {
+	if requested != "" {
+		mac, err := net.ParseMAC(requested)
+		if err != nil {
+			return "", fmt.Errorf("invalid MAC address %s: %s", requested, err)
+		}
+		return mac.String(), nil
+	}
+	if ip := net.ParseIP(lip); ip != nil && ip.To4() != nil {
+		return makeMac(ip), nil
+	}
+	return "", nil
+}
+
 func truncateID(id string) string {
 	return id[:5]
 }
 
-func getBridgeMTU(r *dknet.CreateNetworkRequest) (int, error) {
-	bridgeMTU := defaultMTU
-	if r.Options != nil {
-		if mtu, ok := r.Options[mtuOption].(int); ok {
-			bridgeMTU = mtu
+// detectMTU picks the MTU of a network that has none set: the MTU of the
+// bind interface, less the encapsulation overhead in vxlan mode
+func detectMTU(ns *NetworkState) int {
+	mtu := defaultMTU
+	if ns.FlatBindInterface != "" {
+		if link, err := netlink.LinkByName(ns.FlatBindInterface); err == nil && link.Attrs().MTU > 0 {
+			mtu = link.Attrs().MTU
 		}
 	}
-	return bridgeMTU, nil
-}
-
-func getBridgeName(r *dknet.CreateNetworkRequest) (string, error) {
-	bridgeName := bridgePrefix + truncateID(r.NetworkID)
-	if r.Options != nil {
-		if name, ok := r.Options[bridgeNameOption].(string); ok {
-			bridgeName = name
-		}
+	if ns.Mode == modeVxlan {
+		mtu -= vxlanOverhead
 	}
-	return bridgeName, nil
+	return mtu
 }
 
-func getBridgeMode(r *dknet.CreateNetworkRequest) (string, error) {
-	bridgeMode := defaultMode
-	if r.Options != nil {
-		if mode, ok := r.Options[modeOption].(string); ok {
-			if _, isValid := validModes[mode]; !isValid {
-				return "", fmt.Errorf("%s is not a valid mode", mode)
-			}
-			bridgeMode = mode
-		}
+func getBridgeName(networkID string, config *networkConfig) string {
+	if config.Name != "" {
+		return config.Name
 	}
-	return bridgeMode, nil
+	return bridgePrefix + truncateID(networkID)
 }
 
-func getGatewayIP(r *dknet.CreateNetworkRequest) (string, string, error) {
-	// FIXME: Dear future self, I'm sorry for leaving you with this mess, but I want to get this working ASAP
-	// This should be an array
-	// We need to handle case where we have
-	// a. v6 and v4 - dual stack
-	// auxilliary address
-	// multiple subnets on one network
-	// also in that case, we'll need a function to determine the correct default gateway based on it's IP/Mask
-	var gatewayIP string
-
-	if len(r.IPv6Data) > 0 {
-		if r.IPv6Data[0] != nil {
-			if r.IPv6Data[0].Gateway != "" {
-				gatewayIP = r.IPv6Data[0].Gateway
-			}
-		}
+func getBridgeMode(config *networkConfig) (string, error) {
+	if config.Mode == "" {
+		return defaultMode, nil
 	}
-	// Assumption: IPAM will provide either IPv4 OR IPv6 but not both
-	// We may want to modify this in future to support dual stack
-	if len(r.IPv4Data) > 0 {
-		if r.IPv4Data[0] != nil {
-			if r.IPv4Data[0].Gateway != "" {
-				gatewayIP = r.IPv4Data[0].Gateway
-			}
-		}
+	if _, isValid := validModes[config.Mode]; !isValid {
+		return "", fmt.Errorf("%s is not a valid mode", config.Mode)
 	}
+	return config.Mode, nil
+}
 
-	if gatewayIP == "" {
-		return "", "", fmt.Errorf("No gateway IP found")
-	}
+func splitGateway(gatewayIP string) (string, string, error) {
 	parts := strings.Split(gatewayIP, "/")
-	if parts[0] == "" || parts[1] == "" {
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
 		return "", "", fmt.Errorf("Cannot split gateway IP address")
 	}
 	return parts[0], parts[1], nil
 }
 
-func getBindInterface(r *dknet.CreateNetworkRequest) (string, error) {
-	if r.Options != nil {
-		if mode, ok := r.Options[bindInterfaceOption].(string); ok {
-			return mode, nil
-		}
-	}
+func getBindInterface(config *networkConfig) (string, error) {
+	iface := config.BindInterface
 	// As bind interface is optional and has no default, don't return an error
-	return "", nil
+	if iface != "" && !validateIface(iface) {
+		return "", fmt.Errorf("bind interface %s does not exist", iface)
+	}
+	return iface, nil
+}
+
+func getFipRequest(config *endpointConfig) (string, error) {
+	request := config.Fip
+	if request == "" {
+		return "", nil
+	}
+	if request != fipAuto && request != fipNone && net.ParseIP(request) == nil {
+		return "", fmt.Errorf("%s must be %s, %s or an IP address, got %s", fipOption, fipAuto, fipNone, request)
+	}
+	return request, nil
 }
@@ -0,0 +1,179 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chenleji/docker-bridge-plugin/dknet"
+	"github.com/samalba/dockerclient"
+	"github.com/vishvananda/netlink"
+)
+
+// fakeDocker answers the container lookups of completeJoin. Every endpoint
+// it knows is the only one of a container with the same ID.
+type fakeDocker struct {
+	mu        sync.Mutex
+	endpoints map[string]bool
+}
+
+func (f *fakeDocker) set(endpointID string, present bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if present {
+		f.endpoints[endpointID] = true
+	} else {
+		delete(f.endpoints, endpointID)
+	}
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/containers/json" {
+		containers := []containerSummary{}
+		for id := range f.endpoints {
+			c := containerSummary{Id: id}
+			c.NetworkSettings.Networks = map[string]struct{ EndpointID string }{
+				"network": {EndpointID: id},
+			}
+			containers = append(containers, c)
+		}
+		json.NewEncoder(w).Encode(containers)
+		return
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/json")
+	if !f.endpoints[id] {
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(&containerInfo{Id: id})
+}
+
+// runEndpoint takes an endpoint through its life the way docker does for a
+// container that starts and stops
+func runEndpoint(d *Driver, docker *fakeDocker, networkID, endpointID, address string) error {
+	if err := d.CreateEndpoint(&dknet.CreateEndpointRequest{
+		NetworkID:  networkID,
+		EndpointID: endpointID,
+		Interface:  &dknet.EndpointInterface{Address: address},
+	}); err != nil {
+		return fmt.Errorf("create endpoint %s: %s", endpointID, err)
+	}
+	docker.set(endpointID, true)
+	defer docker.set(endpointID, false)
+
+	if _, err := d.Join(&dknet.JoinRequest{
+		NetworkID:  networkID,
+		EndpointID: endpointID,
+		SandboxKey: "/var/run/docker/netns/" + truncateID(endpointID),
+	}); err != nil {
+		return fmt.Errorf("join endpoint %s: %s", endpointID, err)
+	}
+	// The join completes in the background, the endpoint gets its
+	// container once it has
+	for i := 0; ; i++ {
+		info, err := d.EndpointInfo(&dknet.InfoRequest{NetworkID: networkID, EndpointID: endpointID})
+		if err != nil {
+			return fmt.Errorf("info of endpoint %s: %s", endpointID, err)
+		}
+		if info.Value["container"] == endpointID {
+			break
+		}
+		if i == 500 {
+			return fmt.Errorf("join of endpoint %s did not complete", endpointID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := d.Leave(&dknet.LeaveRequest{NetworkID: networkID, EndpointID: endpointID}); err != nil {
+		return fmt.Errorf("leave endpoint %s: %s", endpointID, err)
+	}
+	if err := d.DeleteEndpoint(&dknet.DeleteEndpointRequest{NetworkID: networkID, EndpointID: endpointID}); err != nil {
+		return fmt.Errorf("delete endpoint %s: %s", endpointID, err)
+	}
+	return nil
+}
+
+// TestConcurrentEndpoints runs the endpoints of several networks at once and
+// is meant for go test -race. The networks are nat bridges set up without
+// their rules and the endpoints publish nothing, so it needs root to create
+// links but no iptables.
+func TestConcurrentEndpoints(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating links needs root")
+	}
+	dir, err := ioutil.TempDir("", "driver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := NewDriver(&Config{StateDir: dir, DriverName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	docker := &fakeDocker{endpoints: make(map[string]bool)}
+	server := httptest.NewServer(docker)
+	defer server.Close()
+	if d.dockerer.client, err = dockerclient.NewDockerClient(server.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	const networks, endpoints = 3, 10
+	for n := 0; n < networks; n++ {
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: fmt.Sprintf("br-race%d", n)}}
+		if err := netlink.LinkAdd(bridge); err != nil {
+			t.Skipf("could not create bridge %s: %s", bridge.Name, err)
+		}
+		defer netlink.LinkDel(bridge)
+		d.setNetwork(fmt.Sprintf("network%d", n), &NetworkState{
+			BridgeName: bridge.Name,
+			MTU:        defaultMTU,
+			Mode:       modeNAT,
+		})
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, networks*endpoints)
+	for n := 0; n < networks; n++ {
+		for i := 0; i < endpoints; i++ {
+			// Links are named after the first 5 characters of the ID
+			endpointID := fmt.Sprintf("e%d%03d", n, i) + strings.Repeat("0", 59)
+			address := fmt.Sprintf("192.168.%d.%d/24", 200+n, 10+i)
+			wg.Add(1)
+			go func(networkID string) {
+				defer wg.Done()
+				errs <- runEndpoint(d, docker, networkID, endpointID, address)
+			}(fmt.Sprintf("network%d", n))
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	for n := 0; n < networks; n++ {
+		if ids := d.endpointIDs(fmt.Sprintf("network%d", n)); len(ids) > 0 {
+			t.Errorf("endpoints %v of network%d left behind", ids, n)
+		}
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range links {
+		if strings.HasPrefix(link.Attrs().Name, brPortPrefix+"e") {
+			t.Errorf("link %s left behind", link.Attrs().Name)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package bridge
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// fipRange is an inclusive range of IPv4 addresses
+type fipRange struct {
+	start uint32
+	end   uint32
+}
+
+// fipKeyPrefix is where floating IP claims live in the cluster store
+const fipKeyPrefix = "fips/"
+
+// fipPool hands out floating IPs from the ranges configured at plugin start
+// and keeps track of which endpoint holds each of them. With a cluster
+// store every address is also claimed there, so that hosts sharing a pool
+// never hand out the same one.
+type fipPool struct {
+	sync.Mutex
+	ranges    []fipRange
+	allocated map[uint32]string
+	claims    kvStore
+}
+
+// newFipPool parses a comma separated list of CIDRs (10.0.2.0/24) and
+// ranges (10.0.2.200-10.0.2.250). An empty spec gives an empty pool.
+func newFipPool(spec string) (*fipPool, error) {
+	p := &fipPool{
+		allocated: make(map[uint32]string),
+	}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		r, err := parseFipRange(part)
+		if err != nil {
+			return nil, err
+		}
+		p.ranges = append(p.ranges, r)
+	}
+	return p, nil
+}
+
+func parseFipRange(s string) (fipRange, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return fipRange{}, fmt.Errorf("invalid floating IP pool %s: %s", s, err)
+		}
+		if ipNet.IP.To4() == nil {
+			return fipRange{}, fmt.Errorf("floating IP pool %s is not IPv4", s)
+		}
+		ones, bits := ipNet.Mask.Size()
+		start := ipToUint32(ipNet.IP)
+		end := start | (1<<uint(bits-ones) - 1)
+		// Leave out the network and broadcast addresses
+		if bits-ones > 1 {
+			start++
+			end--
+		}
+		return fipRange{start, end}, nil
+	}
+
+	bounds := strings.SplitN(s, "-", 2)
+	if len(bounds) != 2 {
+		return fipRange{}, fmt.Errorf("invalid floating IP pool %s", s)
+	}
+	start := net.ParseIP(strings.TrimSpace(bounds[0]))
+	end := net.ParseIP(strings.TrimSpace(bounds[1]))
+	if start == nil || end == nil || start.To4() == nil || end.To4() == nil {
+		return fipRange{}, fmt.Errorf("invalid floating IP range %s", s)
+	}
+	r := fipRange{ipToUint32(start), ipToUint32(end)}
+	if r.start > r.end {
+		return fipRange{}, fmt.Errorf("floating IP range %s ends before it starts", s)
+	}
+	return r, nil
+}
+
+// Empty reports whether no floating IPs were configured
+func (p *fipPool) Empty() bool {
+	return len(p.ranges) == 0
+}
+
+// Allocate reserves the first free floating IP for an endpoint
+func (p *fipPool) Allocate(endpointID string) (net.IP, error) {
+	p.Lock()
+	defer p.Unlock()
+	for _, r := range p.ranges {
+		for ip := r.start; ip <= r.end && ip >= r.start; ip++ {
+			if _, used := p.allocated[ip]; !used {
+				if err := p.claim(ip, endpointID); err == errKeyExists {
+					continue
+				} else if err != nil {
+					return nil, err
+				}
+				p.allocated[ip] = endpointID
+				log.Debugf("Allocated floating IP [ %s ] to endpoint [ %s ]", uint32ToIP(ip), endpointID)
+				return uint32ToIP(ip), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no floating IP left in the pool")
+}
+
+// Request reserves a specific floating IP for an endpoint. The address does
+// not have to be inside the configured pool but it can only be held once.
+func (p *fipPool) Request(endpointID string, ip net.IP) error {
+	if ip.To4() == nil {
+		return fmt.Errorf("floating IP %s is not IPv4", ip)
+	}
+	p.Lock()
+	defer p.Unlock()
+	n := ipToUint32(ip)
+	if owner, used := p.allocated[n]; used {
+		return fmt.Errorf("floating IP %s is already held by endpoint %s", ip, owner)
+	}
+	if err := p.claim(n, endpointID); err == errKeyExists {
+		return fmt.Errorf("floating IP %s is already held by another host", ip)
+	} else if err != nil {
+		return err
+	}
+	p.allocated[n] = endpointID
+	log.Debugf("Reserved floating IP [ %s ] for endpoint [ %s ]", ip, endpointID)
+	return nil
+}
+
+// Contains reports whether ip is inside one of the configured ranges
+func (p *fipPool) Contains(ip net.IP) bool {
+	if ip.To4() == nil {
+		return false
+	}
+	n := ipToUint32(ip)
+	for _, r := range p.ranges {
+		if n >= r.start && n <= r.end {
+			return true
+		}
+	}
+	return false
+}
+
+// Held reports whether ip is allocated to an endpoint
+func (p *fipPool) Held(ip net.IP) bool {
+	if ip.To4() == nil {
+		return false
+	}
+	p.Lock()
+	defer p.Unlock()
+	_, held := p.allocated[ipToUint32(ip)]
+	return held
+}
+
+// Claimed reports whether ip is held here or, with a cluster store, by
+// another host
+func (p *fipPool) Claimed(ip net.IP) bool {
+	if p.Held(ip) {
+		return true
+	}
+	if p.claims == nil || ip.To4() == nil {
+		return false
+	}
+	_, err := p.claims.Get(fipKeyPrefix + ip.To4().String())
+	return err == nil
+}
+
+// Overlaps reports whether subnet shares an address with the configured
+// ranges
+func (p *fipPool) Overlaps(subnet *net.IPNet) bool {
+	if subnet.IP.To4() == nil {
+		return false
+	}
+	ones, bits := subnet.Mask.Size()
+	start := ipToUint32(subnet.IP)
+	end := start | (1<<uint(bits-ones) - 1)
+	for _, r := range p.ranges {
+		if start <= r.end && r.start <= end {
+			return true
+		}
+	}
+	return false
+}
+
+// Release returns a floating IP to the pool
+func (p *fipPool) Release(ip string) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	n := ipToUint32(parsed)
+	if _, held := p.allocated[n]; held && p.claims != nil {
+		if err := p.claims.Delete(fipKeyPrefix + ip); err != nil {
+			log.Warnf("Could not release the claim on floating IP [ %s ]: %s", ip, err)
+		}
+	}
+	delete(p.allocated, n)
+	log.Debugf("Released floating IP [ %s ]", ip)
+}
+
+// claim takes ip in the cluster store for an endpoint. It returns
+// errKeyExists when another endpoint has it, claims already made by the
+// same endpoint, before a restart, are kept.
+func (p *fipPool) claim(n uint32, endpointID string) error {
+	if p.claims == nil {
+		return nil
+	}
+	key := fipKeyPrefix + uint32ToIP(n).String()
+	err := p.claims.PutIfAbsent(key, []byte(endpointID))
+	if err != errKeyExists {
+		return err
+	}
+	if owner, getErr := p.claims.Get(key); getErr == nil && string(owner) == endpointID {
+		return nil
+	}
+	return err
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
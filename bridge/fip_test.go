@@ -0,0 +1,46 @@
+package bridge
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseFipRange(t *testing.T) {
+	tests := []struct {
+		spec       string
+		start, end string
+		err        bool
+	}{
+		// The network and broadcast addresses are left out of a CIDR
+		{spec: "10.0.2.0/24", start: "10.0.2.1", end: "10.0.2.254"},
+		{spec: "10.0.2.9/24", start: "10.0.2.1", end: "10.0.2.254"},
+		{spec: "10.0.2.4/31", start: "10.0.2.4", end: "10.0.2.5"},
+		{spec: "10.0.2.7/32", start: "10.0.2.7", end: "10.0.2.7"},
+		{spec: "10.0.2.200-10.0.2.250", start: "10.0.2.200", end: "10.0.2.250"},
+		{spec: "10.0.2.200 - 10.0.2.250", start: "10.0.2.200", end: "10.0.2.250"},
+		{spec: "10.0.2.200-10.0.2.200", start: "10.0.2.200", end: "10.0.2.200"},
+		{spec: "10.0.2.250-10.0.2.200", err: true},
+		{spec: "10.0.2.200", err: true},
+		{spec: "10.0.2.200-", err: true},
+		{spec: "10.0.2.0/33", err: true},
+		{spec: "fd00::/64", err: true},
+		{spec: "fd00::1-fd00::9", err: true},
+	}
+	for _, test := range tests {
+		r, err := parseFipRange(test.spec)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.spec, r)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.spec, err)
+			continue
+		}
+		want := fipRange{ipToUint32(net.ParseIP(test.start)), ipToUint32(net.ParseIP(test.end))}
+		if r != want {
+			t.Errorf("%s: got %+v, want %+v", test.spec, r, want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package bridge
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/libnetwork/iptables"
+	"github.com/vishvananda/netlink"
+)
+
+// CollectGarbage removes the veths, bridges, vxlan devices, floating IPs
+// and iptables rules that follow the driver's naming and tagging conventions
+// but are not in its state. They are left behind by failed requests and crashes.
+func (d *Driver) CollectGarbage() {
+	d.opLock.Lock()
+	defer d.opLock.Unlock()
+	log.Debugf("Collecting garbage")
+	d.collectLinks()
+	orphanFips := d.collectRules()
+	d.collectFips(orphanFips)
+}
+
+// StartGC runs the garbage collector every interval
+func (d *Driver) StartGC(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			d.CollectGarbage()
+		}
+	}()
+}
+
+func (d *Driver) collectLinks() {
+	links, err := netlink.LinkList()
+	if err != nil {
+		log.Errorf("GC could not list links: %s", err)
+		return
+	}
+	veths := make(map[string]bool)
+	for id := range d.endpoints {
+		veths[brPortPrefix+truncateID(id)] = true
+		veths[childLinkName(truncateID(id))] = true
+	}
+
+	for _, link := range links {
+		name := link.Attrs().Name
+		alias := link.Attrs().Alias
+		switch {
+		case strings.HasPrefix(name, brPortPrefix), strings.HasPrefix(name, childPrefix):
+			if veths[name] {
+				continue
+			}
+		case (link.Type() == "bridge" || link.Type() == "vxlan" || link.Type() == "vlan") && strings.HasPrefix(alias, bridgeAliasPrefix):
+			if _, ok := d.networks[strings.TrimPrefix(alias, bridgeAliasPrefix)]; ok {
+				continue
+			}
+			if link.Type() == "bridge" && !releaseUplinks(link, links) {
+				continue
+			}
+		default:
+			continue
+		}
+		log.Infof("GC deleting orphaned link [ %s ]", name)
+		if err := netlink.LinkDel(link); err != nil {
+			log.Errorf("GC could not delete link [ %s ]: %s", name, err)
+		}
+	}
+}
+
+// collectFips removes /32 addresses that are floating IPs no endpoint holds.
+// Floating IPs are the addresses inside the pool plus the destinations of
+// orphaned DNAT rules, which covers addresses requested outside the pool.
+func (d *Driver) collectFips(orphans map[string]bool) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		log.Errorf("GC could not list links: %s", err)
+		return
+	}
+	for _, link := range links {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ones, _ := addr.Mask.Size(); ones != 32 {
+				continue
+			}
+			if !d.fips.Contains(addr.IP) && !orphans[addr.IP.String()] {
+				continue
+			}
+			if d.fips.Held(addr.IP) {
+				continue
+			}
+			log.Infof("GC deleting orphaned floating ip [ %s ] from [ %s ]", addr.IP, link.Attrs().Name)
+			if err := netlink.AddrDel(link, &addr); err != nil {
+				log.Errorf("GC could not delete address [ %s ]: %s", addr.IP, err)
+			}
+		}
+	}
+}
+
+// releaseUplinks hands the host NICs enslaved to an orphaned bridge their
+// addresses and routes back, the bridge of a flat network holds them. It
+// reports whether the bridge can be deleted.
+func releaseUplinks(br netlink.Link, links []netlink.Link) bool {
+	for _, port := range links {
+		name := port.Attrs().Name
+		if port.Attrs().MasterIndex != br.Attrs().Index || strings.HasPrefix(name, brPortPrefix) {
+			continue
+		}
+		// Vlan and vxlan uplinks carry no host addresses
+		if port.Type() == "vlan" || port.Type() == "vxlan" {
+			continue
+		}
+		if err := detachUplink(br.Attrs().Name, name, true); err != nil {
+			log.Errorf("GC could not detach [ %s ] from bridge [ %s ], keeping the bridge: %s", name, br.Attrs().Name, err)
+			return false
+		}
+	}
+	return true
+}
+
+// gcChains are the chains the driver puts tagged rules in, by table and
+// by the command that manages them
+var gcChains = []struct {
+	raw   func(...string) ([]byte, error)
+	table string
+	chain string
+}{
+	{iptables.Raw, "nat", "POSTROUTING"},
+	{iptables.Raw, "nat", "DOCKER"},
+	{iptables.Raw, "filter", "FORWARD"},
+	{iptables.Raw, "filter", isolationChain},
+	{ip6tablesRaw, "nat", "POSTROUTING"},
+	{ip6tablesRaw, "filter", "FORWARD"},
+	{ip6tablesRaw, "filter", isolationChain},
+}
+
+// collectRules removes the tagged rules that do not belong to a network or
+// endpoint in the state. It returns the floating IPs of the DNAT rules it
+// removed.
+func (d *Driver) collectRules() map[string]bool {
+	orphanFips := make(map[string]bool)
+	for _, c := range gcChains {
+		raw, table, chain := c.raw, c.table, c.chain
+		output, err := raw("-t", table, "-S", chain)
+		if err != nil {
+			log.Debugf("GC could not list chain [ %s ]: %s", chain, err)
+			continue
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			rule := strings.Fields(line)
+			if len(rule) < 2 || rule[0] != "-A" || !strings.Contains(line, ruleComment) {
+				continue
+			}
+			if d.ruleOwned(rule) {
+				continue
+			}
+			// Published ports DNAT host addresses, not floating IPs
+			if ruleArg(rule, "-j") == "DNAT" && ruleArg(rule, "--dport") == "" {
+				if ip, _, err := net.ParseCIDR(ruleArg(rule, "-d")); err == nil {
+					orphanFips[ip.String()] = true
+				}
+			}
+			log.Infof("GC deleting orphaned rule [ %s ]", line)
+			if _, err := raw(append([]string{"-t", table, "-D"}, rule[1:]...)...); err != nil {
+				log.Errorf("GC could not delete rule [ %s ]: %s", line, err)
+			}
+		}
+	}
+	return orphanFips
+}
+
+// ruleOwned tells whether a rule in iptables -S form belongs to the state
+func (d *Driver) ruleOwned(rule []string) bool {
+	if rule[1] == isolationChain {
+		want := strings.Join(isolationRule(ruleArg(rule, "-i"), ruleArg(rule, "-o")), " ")
+		for _, r := range isolationRules(d.networks) {
+			if strings.Join(r, " ") == want {
+				return true
+			}
+		}
+		return false
+	}
+	switch ruleArg(rule, "-j") {
+	case isolationChain:
+		return true
+	case "MASQUERADE":
+		bridgeName := ruleArg(rule, "-o")
+		for _, network := range d.networks {
+			if network.BridgeName == bridgeName {
+				return true
+			}
+		}
+	case "DROP":
+		bridgeName := ruleArg(rule, "-o")
+		if bridgeName == "" {
+			bridgeName = ruleArg(rule, "-i")
+		}
+		for _, network := range d.networks {
+			if (network.Internal || network.DisableICC) && network.BridgeName == bridgeName {
+				return true
+			}
+		}
+	case "DNAT":
+		if dport := ruleArg(rule, "--dport"); dport != "" {
+			return d.portRuleOwned(ruleArg(rule, "-p"), dport, ruleArg(rule, "--to-destination"))
+		}
+		fip, _, err := net.ParseCIDR(ruleArg(rule, "-d"))
+		if err != nil {
+			return false
+		}
+		lip := ruleArg(rule, "--to-destination")
+		for _, ep := range d.endpoints {
+			if ep.Fip == fip.String() && ep.Lip == lip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// portRuleOwned tells whether a published port rule belongs to an endpoint
+// that has joined its container
+func (d *Driver) portRuleOwned(proto, dport, destination string) bool {
+	for _, ep := range d.endpoints {
+		if ep.SandboxKey == "" {
+			continue
+		}
+		for _, b := range ep.Ports {
+			if b.protocol() == proto && strconv.Itoa(b.HostPort) == dport &&
+				net.JoinHostPort(ep.Lip, strconv.Itoa(b.Port)) == destination {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ruleArg returns the value following flag in a rule
+func ruleArg(rule []string, flag string) string {
+	for i := 0; i < len(rule)-1; i++ {
+		if rule[i] == flag {
+			return rule[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,366 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/chenleji/docker-bridge-plugin/dknet"
+)
+
+const (
+	localAddressSpace  = "local"
+	globalAddressSpace = "global"
+
+	// Pools and addresses live in a store under these prefixes, addresses
+	// grouped by pool
+	ipamPoolPrefix    = "ipam/pools/"
+	ipamAddressPrefix = "ipam/addresses/"
+
+	// requestAddressType is the option docker marks the gateway request with
+	requestAddressType = "RequestAddressType"
+	gatewayAddressType = "com.docker.network.gateway"
+)
+
+// ipamPool is a pool handed to docker
+type ipamPool struct {
+	ID           string
+	AddressSpace string
+	Pool         string
+	SubPool      string
+}
+
+// ipam gives out pools and addresses to docker. Every pool and address is
+// claimed in a store, the cluster store for the global address space so
+// that the hosts agree and the one in the state directory for the local
+// one. Container addresses and floating IPs never overlap: pools can not
+// cover the floating IP ranges and addresses held as floating IPs are
+// skipped.
+type ipam struct {
+	mu       sync.Mutex
+	local    kvStore
+	cluster  kvStore
+	defaults []*net.IPNet
+	fips     *fipPool
+}
+
+// newIpam parses defaults, the comma separated CIDRs handed out to networks
+// created without a subnet
+func newIpam(local, cluster kvStore, defaults string, fips *fipPool) (*ipam, error) {
+	m := &ipam{local: local, cluster: cluster, fips: fips}
+	for _, cidr := range strings.Split(defaults, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid default pool %s: %s", cidr, err)
+		}
+		m.defaults = append(m.defaults, subnet)
+	}
+	return m, nil
+}
+
+// store returns where the pools of an address space are kept
+func (m *ipam) store(space string) (kvStore, error) {
+	switch space {
+	case localAddressSpace:
+		return m.local, nil
+	case globalAddressSpace:
+		if m.cluster == nil {
+			return nil, fmt.Errorf("the %s address space needs a cluster store", globalAddressSpace)
+		}
+		return m.cluster, nil
+	default:
+		return nil, fmt.Errorf("unknown address space %s", space)
+	}
+}
+
+func poolID(space, pool, subPool string) string {
+	id := space + "-" + strings.Replace(pool, "/", "_", -1)
+	if subPool != "" {
+		id += "-" + strings.Replace(subPool, "/", "_", -1)
+	}
+	return id
+}
+
+// getPool reads a pool back from the store of the address space its ID
+// starts with
+func (m *ipam) getPool(id string) (*ipamPool, kvStore, error) {
+	store, err := m.store(strings.SplitN(id, "-", 2)[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := store.Get(ipamPoolPrefix + id)
+	if err == errKeyNotFound {
+		return nil, nil, fmt.Errorf("pool %s not found", id)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := &ipamPool{}
+	if err := json.Unmarshal(data, pool); err != nil {
+		return nil, nil, fmt.Errorf("invalid pool %s: %s", id, err)
+	}
+	return pool, store, nil
+}
+
+func (m *ipam) listPools(store kvStore) ([]*ipamPool, error) {
+	values, err := store.List(ipamPoolPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var pools []*ipamPool
+	for key, data := range values {
+		pool := &ipamPool{}
+		if err := json.Unmarshal(data, pool); err != nil {
+			log.Warnf("Skipping invalid pool [ %s ]: %s", key, err)
+			continue
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+// checkPool makes sure a new pool overlaps neither the floating IPs nor
+// the pools already handed out
+func (m *ipam) checkPool(subnet *net.IPNet, pools []*ipamPool) error {
+	if m.fips.Overlaps(subnet) {
+		return fmt.Errorf("pool %s overlaps the floating IP pool", subnet)
+	}
+	for _, pool := range pools {
+		_, other, err := net.ParseCIDR(pool.Pool)
+		if err != nil {
+			continue
+		}
+		if other.Contains(subnet.IP) || subnet.Contains(other.IP) {
+			return fmt.Errorf("pool %s overlaps pool %s", subnet, pool.Pool)
+		}
+	}
+	return nil
+}
+
+func (m *ipam) GetIpamCapabilities() (*dknet.IpamCapabilitiesResponse, error) {
+	return &dknet.IpamCapabilitiesResponse{RequiresMACAddress: false}, nil
+}
+
+func (m *ipam) GetDefaultAddressSpaces() (*dknet.AddressSpacesResponse, error) {
+	return &dknet.AddressSpacesResponse{
+		LocalDefaultAddressSpace:  localAddressSpace,
+		GlobalDefaultAddressSpace: globalAddressSpace,
+	}, nil
+}
+
+// RequestPool claims the subnet given with --subnet, or the first default
+// pool that is still free
+func (m *ipam) RequestPool(r *dknet.RequestPoolRequest) (*dknet.RequestPoolResponse, error) {
+	log.Debugf("Request pool request: %+v", r)
+	space := r.AddressSpace
+	if space == "" {
+		space = localAddressSpace
+	}
+	store, err := m.store(space)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pools, err := m.listPools(store)
+	if err != nil {
+		return nil, err
+	}
+
+	var subnet *net.IPNet
+	if r.Pool != "" {
+		if _, subnet, err = net.ParseCIDR(r.Pool); err != nil {
+			return nil, fmt.Errorf("invalid pool %s: %s", r.Pool, err)
+		}
+		if (subnet.IP.To4() == nil) != r.V6 {
+			return nil, fmt.Errorf("pool %s is not of the requested address family", r.Pool)
+		}
+		if err := m.checkPool(subnet, pools); err != nil {
+			return nil, err
+		}
+	} else {
+		if r.V6 {
+			return nil, fmt.Errorf("IPv6 networks need a subnet")
+		}
+		for _, candidate := range m.defaults {
+			if candidate.IP.To4() != nil && m.checkPool(candidate, pools) == nil {
+				subnet = candidate
+				break
+			}
+		}
+		if subnet == nil {
+			return nil, fmt.Errorf("no default pool left, create the network with a subnet")
+		}
+	}
+	if r.SubPool != "" {
+		_, sub, err := net.ParseCIDR(r.SubPool)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sub pool %s: %s", r.SubPool, err)
+		}
+		if !subnet.Contains(sub.IP) {
+			return nil, fmt.Errorf("sub pool %s is not in pool %s", r.SubPool, subnet)
+		}
+	}
+
+	pool := &ipamPool{
+		ID:           poolID(space, subnet.String(), r.SubPool),
+		AddressSpace: space,
+		Pool:         subnet.String(),
+		SubPool:      r.SubPool,
+	}
+	data, err := json.Marshal(pool)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.PutIfAbsent(ipamPoolPrefix+pool.ID, data); err == errKeyExists {
+		return nil, fmt.Errorf("pool %s is already in use", pool.Pool)
+	} else if err != nil {
+		return nil, err
+	}
+	log.Infof("Allocated pool [ %s ] in address space [ %s ]", pool.Pool, space)
+	return &dknet.RequestPoolResponse{PoolID: pool.ID, Pool: pool.Pool}, nil
+}
+
+// ReleasePool gives back a pool and every address still claimed in it
+func (m *ipam) ReleasePool(r *dknet.ReleasePoolRequest) error {
+	log.Debugf("Release pool request: %+v", r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pool, store, err := m.getPool(r.PoolID)
+	if err != nil {
+		return err
+	}
+	addresses, err := store.List(ipamAddressPrefix + pool.ID + "/")
+	if err != nil {
+		return err
+	}
+	for key := range addresses {
+		if err := store.Delete(key); err != nil {
+			log.Warnf("Could not release address [ %s ]: %s", key, err)
+		}
+	}
+	if err := store.Delete(ipamPoolPrefix + pool.ID); err != nil {
+		return err
+	}
+	log.Infof("Released pool [ %s ]", pool.Pool)
+	return nil
+}
+
+// RequestAddress claims the address docker asked for, or the first free one
+// of the sub pool, or of the pool when there is none
+func (m *ipam) RequestAddress(r *dknet.RequestAddressRequest) (*dknet.RequestAddressResponse, error) {
+	log.Debugf("Request address request: %+v", r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pool, store, err := m.getPool(r.PoolID)
+	if err != nil {
+		return nil, err
+	}
+	_, subnet, err := net.ParseCIDR(pool.Pool)
+	if err != nil {
+		return nil, err
+	}
+	ones, _ := subnet.Mask.Size()
+	prefix := ipamAddressPrefix + pool.ID + "/"
+
+	if r.Address != "" {
+		ip := net.ParseIP(r.Address)
+		if ip == nil || !subnet.Contains(ip) {
+			return nil, fmt.Errorf("address %s is not in pool %s", r.Address, pool.Pool)
+		}
+		if err := store.PutIfAbsent(prefix+ip.String(), []byte(r.Options[requestAddressType])); err == errKeyExists {
+			return nil, fmt.Errorf("address %s is already in use", ip)
+		} else if err != nil {
+			return nil, err
+		}
+		return &dknet.RequestAddressResponse{Address: fmt.Sprintf("%s/%d", ip, ones)}, nil
+	}
+
+	rng := subnet
+	if pool.SubPool != "" {
+		_, rng, _ = net.ParseCIDR(pool.SubPool)
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, rng.IP.To16())
+	for ip = ipIncrement(ip); rng.Contains(ip); ip = ipIncrement(ip) {
+		if ip4 := ip.To4(); ip4 != nil && ones < 31 && isBroadcast(ip4, subnet) {
+			continue
+		}
+		if m.fips.Claimed(ip) {
+			continue
+		}
+		err := store.PutIfAbsent(prefix+ip.String(), []byte(r.Options[requestAddressType]))
+		if err == errKeyExists {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("Allocated address [ %s ] from pool [ %s ]", ip, pool.Pool)
+		return &dknet.RequestAddressResponse{Address: fmt.Sprintf("%s/%d", ip, ones)}, nil
+	}
+	return nil, fmt.Errorf("no address left in pool %s", pool.Pool)
+}
+
+func (m *ipam) ReleaseAddress(r *dknet.ReleaseAddressRequest) error {
+	log.Debugf("Release address request: %+v", r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pool, store, err := m.getPool(r.PoolID)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(r.Address)
+	if ip == nil {
+		return fmt.Errorf("invalid address %s", r.Address)
+	}
+	return store.Delete(ipamAddressPrefix + pool.ID + "/" + ip.String())
+}
+
+// Allocated reports whether ip was given to a container from one of the
+// pools, floating IPs must not take it
+func (m *ipam) Allocated(ip net.IP) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, store := range []kvStore{m.local, m.cluster} {
+		if store == nil {
+			continue
+		}
+		pools, err := m.listPools(store)
+		if err != nil {
+			log.Warnf("Could not list pools: %s", err)
+			continue
+		}
+		for _, pool := range pools {
+			_, subnet, err := net.ParseCIDR(pool.Pool)
+			if err != nil || !subnet.Contains(ip) {
+				continue
+			}
+			if _, err := store.Get(ipamAddressPrefix + pool.ID + "/" + ip.String()); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isBroadcast tells whether ip is the last address of subnet
+func isBroadcast(ip net.IP, subnet *net.IPNet) bool {
+	network := subnet.IP.To4()
+	if network == nil {
+		return false
+	}
+	for i := range ip {
+		if ip[i] != network[i]|^subnet.Mask[len(subnet.Mask)-4+i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package bridge
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/chenleji/docker-bridge-plugin/dknet"
+)
+
+func newTestIpam(t *testing.T, dir string) *ipam {
+	store, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fips, err := newFipPool("10.10.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newIpam(store, nil, "", fips)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestRequestAddress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := newTestIpam(t, dir)
+
+	if _, err := m.RequestPool(&dknet.RequestPoolRequest{Pool: "10.10.1.0/25"}); err == nil {
+		t.Error("expected an error for a pool overlapping the floating IPs")
+	}
+	pool, err := m.RequestPool(&dknet.RequestPoolRequest{Pool: "10.10.0.0/30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(address string) (string, error) {
+		res, err := m.RequestAddress(&dknet.RequestAddressRequest{PoolID: pool.PoolID, Address: address})
+		if err != nil {
+			return "", err
+		}
+		return res.Address, nil
+	}
+	expect := func(address, want string) {
+		got, err := request(address)
+		if err != nil {
+			t.Fatalf("requesting %q: %s", address, err)
+		}
+		if got != want {
+			t.Fatalf("requesting %q: got %s, want %s", address, got, want)
+		}
+	}
+	expectError := func(address string) {
+		if got, err := request(address); err == nil {
+			t.Fatalf("requesting %q: expected an error, got %s", address, got)
+		}
+	}
+
+	expect("10.10.0.2", "10.10.0.2/30")
+	expectError("10.10.0.2")
+	expectError("10.10.2.1")
+	expectError("not an address")
+	expect("", "10.10.0.1/30")
+	// The broadcast address is left out
+	expectError("")
+
+	if err := m.ReleaseAddress(&dknet.ReleaseAddressRequest{PoolID: pool.PoolID, Address: "10.10.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Allocated(net.ParseIP("10.10.0.2")) || m.Allocated(net.ParseIP("10.10.0.1")) {
+		t.Error("Allocated does not match the claimed addresses")
+	}
+
+	// The claims are in the store, not in the ipam
+	m = newTestIpam(t, dir)
+	expectError("10.10.0.2")
+	expect("", "10.10.0.1/30")
+
+	if _, err := m.RequestAddress(&dknet.RequestAddressRequest{PoolID: "local-10.99.0.0_24"}); err == nil {
+		t.Error("expected an error for an unknown pool")
+	}
+}
@@ -0,0 +1,289 @@
+package bridge
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/libnetwork/iptables"
+)
+
+// isolationChain holds a DROP rule for every pair of bridges of the driver
+// that may not talk, like DOCKER-ISOLATION does for docker's bridges. It is
+// jumped to from the top of FORWARD.
+const isolationChain = "BRIDGE-PLUGIN-ISOLATION"
+
+// isolationMu keeps two networks being set up at once from both adding the
+// rules they find missing
+var isolationMu sync.Mutex
+
+// isolated tells whether a network takes part in the isolation. Routed
+// networks forward through the veths rather than their bridge and child
+// modes have no bridge at all. A flat network without a VLAN holds the host
+// uplink, the other networks get out through its bridge.
+func isolated(network *NetworkState) bool {
+	switch network.Mode {
+	case modeNAT, modeVxlan:
+		return network.BridgeName != ""
+	case modeFlat:
+		return network.BridgeName != "" && !holdsUplink(network)
+	}
+	return false
+}
+
+// allowsNetwork tells whether a network lists another in its allowed
+// networks, by ID or by the start of it
+func allowsNetwork(network *NetworkState, otherID string) bool {
+	for _, allowed := range network.AllowNetworks {
+		if strings.HasPrefix(otherID, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func isolationRule(from, to string) []string {
+	return []string{
+		"-i", from,
+		"-o", to,
+		"-m", "comment", "--comment", ruleComment,
+		"-j", "DROP",
+	}
+}
+
+// isolationRules returns the rules the chain should hold. Either network
+// of a pair allowing the other opens both ways, so that replies get back.
+func isolationRules(networks map[string]*NetworkState) [][]string {
+	var ids []string
+	for id, network := range networks {
+		if isolated(network) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	var rules [][]string
+	seen := make(map[string]bool)
+	for _, a := range ids {
+		for _, b := range ids {
+			na, nb := networks[a], networks[b]
+			if a == b || na.BridgeName == nb.BridgeName {
+				continue
+			}
+			if allowsNetwork(na, b) || allowsNetwork(nb, a) {
+				continue
+			}
+			rule := isolationRule(na.BridgeName, nb.BridgeName)
+			if key := strings.Join(rule, " "); !seen[key] {
+				seen[key] = true
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return rules
+}
+
+func isolationRaws(networks map[string]*NetworkState) []func(...string) ([]byte, error) {
+	for _, network := range networks {
+		if isolated(network) && network.Gateway6 != "" {
+			return internalRaws(true)
+		}
+	}
+	return internalRaws(false)
+}
+
+// updateIsolation brings the isolation chain in line with the networks of
+// the driver, adding the missing rules before removing the stale ones so
+// that no pair is open in between
+func (d *Driver) updateIsolation() error {
+	d.mu.Lock()
+	networks := make(map[string]*NetworkState)
+	for id, network := range d.networks {
+		networks[id] = network
+	}
+	d.mu.Unlock()
+
+	isolationMu.Lock()
+	defer isolationMu.Unlock()
+	want := isolationRules(networks)
+	for i, raw := range isolationRaws(networks) {
+		if err := syncIsolation(raw, want); err != nil {
+			if i == 0 {
+				return err
+			}
+			log.Warnf("Could not update IPv6 isolation rules: %s", err)
+		}
+	}
+	return nil
+}
+
+func syncIsolation(raw func(...string) ([]byte, error), want [][]string) error {
+	if err := ensureIsolationChain(raw); err != nil {
+		return err
+	}
+	output, err := raw("-t", "filter", "-S", isolationChain)
+	if err != nil {
+		return err
+	}
+	// Rules are counted, a copy left by an earlier sync must go as well
+	have := make(map[string]int)
+	for _, line := range strings.Split(string(output), "\n") {
+		rule := strings.Fields(line)
+		if len(rule) > 2 && rule[0] == "-A" && strings.Contains(line, ruleComment) {
+			have[strings.Join(isolationRule(ruleArg(rule, "-i"), ruleArg(rule, "-o")), " ")]++
+		}
+	}
+	wanted := make(map[string]bool)
+	for _, rule := range want {
+		key := strings.Join(rule, " ")
+		wanted[key] = true
+		if have[key] > 0 {
+			continue
+		}
+		if output, err := raw(append([]string{"-t", "filter", "-A", isolationChain}, rule...)...); err != nil {
+			return err
+		} else if len(output) > 0 {
+			return &iptables.ChainError{Chain: isolationChain, Output: output}
+		}
+		have[key] = 1
+	}
+	for key, count := range have {
+		if wanted[key] {
+			count--
+		}
+		for ; count > 0; count-- {
+			if _, err := raw(append([]string{"-t", "filter", "-D", isolationChain}, strings.Fields(key)...)...); err != nil {
+				log.Warnf("Could not delete isolation rule [ %s ]: %s", key, err)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// ensureIsolationChain creates the chain and the jump to it
+func ensureIsolationChain(raw func(...string) ([]byte, error)) error {
+	if _, err := raw("-t", "filter", "-S", isolationChain); err != nil {
+		if _, err := raw("-t", "filter", "-N", isolationChain); err != nil {
+			return fmt.Errorf("could not create chain %s: %s", isolationChain, err)
+		}
+	}
+	jump := []string{
+		"FORWARD", "-t", "filter",
+		"-m", "comment", "--comment", ruleComment,
+		"-j", isolationChain,
+	}
+	if _, err := raw(append([]string{"-C"}, jump...)...); err == nil {
+		return nil
+	}
+	if output, err := raw(append([]string{"-I"}, jump...)...); err != nil {
+		return err
+	} else if len(output) > 0 {
+		return &iptables.ChainError{Chain: "FORWARD", Output: output}
+	}
+	return nil
+}
+
+// delIsolation removes the rules of a bridge that goes away
+func delIsolation(bridgeName string) {
+	isolationMu.Lock()
+	defer isolationMu.Unlock()
+	for _, raw := range internalRaws(true) {
+		output, err := raw("-t", "filter", "-S", isolationChain)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			rule := strings.Fields(line)
+			if len(rule) < 2 || rule[0] != "-A" || !strings.Contains(line, ruleComment) {
+				continue
+			}
+			if ruleArg(rule, "-i") != bridgeName && ruleArg(rule, "-o") != bridgeName {
+				continue
+			}
+			if _, err := raw(append([]string{"-t", "filter", "-D"}, rule[1:]...)...); err != nil {
+				log.Warnf("Could not delete isolation rule [ %s ]: %s", line, err)
+			}
+		}
+	}
+}
+
+// iccRules keep the containers of a bridge from talking to each other. They
+// only match traffic between container ports, and in vxlan mode towards the
+// other hosts, so the gateway, the uplink of a flat network and floating IP
+// ingress keep working.
+func iccRules(network *NetworkState) [][]string {
+	outs := []string{brPortPrefix + "+"}
+	if network.VxlanInterface != "" {
+		outs = append(outs, network.VxlanInterface)
+	}
+	var rules [][]string
+	for _, out := range outs {
+		rules = append(rules, []string{
+			"FORWARD",
+			"-i", network.BridgeName,
+			"-o", network.BridgeName,
+			"-m", "physdev", "--physdev-in", brPortPrefix + "+", "--physdev-out", out,
+			"-m", "comment", "--comment", ruleComment,
+			"-j", "DROP",
+		})
+	}
+	return rules
+}
+
+// enableBridgeNetfilter makes bridged traffic go through iptables, which
+// the ICC rules need. It loads br_netfilter if it is not there yet.
+func enableBridgeNetfilter(ipv6 bool) error {
+	names := []string{"net/bridge/bridge-nf-call-iptables"}
+	if ipv6 {
+		names = append(names, "net/bridge/bridge-nf-call-ip6tables")
+	}
+	if _, err := os.Stat(filepath.Join("/proc/sys", names[0])); os.IsNotExist(err) {
+		if output, err := exec.Command("modprobe", "br_netfilter").CombinedOutput(); err != nil {
+			return fmt.Errorf("could not load br_netfilter: %s (%s)", output, err)
+		}
+	}
+	for _, name := range names {
+		if err := setSysctl(name, "1"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addIccRules(network *NetworkState) error {
+	ipv6 := network.Gateway6 != ""
+	if err := enableBridgeNetfilter(ipv6); err != nil {
+		return err
+	}
+	for _, raw := range internalRaws(ipv6) {
+		for _, rule := range iccRules(network) {
+			if _, err := raw(append([]string{"-C"}, rule...)...); err == nil {
+				continue
+			}
+			if output, err := raw(append([]string{"-I"}, rule...)...); err != nil {
+				return err
+			} else if len(output) > 0 {
+				return &iptables.ChainError{Chain: "FORWARD", Output: output}
+			}
+		}
+	}
+	return nil
+}
+
+func delIccRules(network *NetworkState) {
+	for _, raw := range internalRaws(network.Gateway6 != "") {
+		for _, rule := range iccRules(network) {
+			if _, err := raw(append([]string{"-C"}, rule...)...); err != nil {
+				continue
+			}
+			if _, err := raw(append([]string{"-D"}, rule...)...); err != nil {
+				log.Warnf("Could not delete ICC rule of bridge [ %s ]: %s", network.BridgeName, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package bridge
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIsolationRules(t *testing.T) {
+	networks := map[string]*NetworkState{
+		"aaaa1": {Mode: modeNAT, BridgeName: "br-a"},
+		"bbbb1": {Mode: modeVxlan, BridgeName: "br-b"},
+		"cccc1": {Mode: modeFlat, BridgeName: "br-c", VlanID: 10, AllowNetworks: []string{"aaaa"}},
+		// Not isolated: the host uplink, no bridge of their own to forward
+		// through, or no bridge at all
+		"eeee1": {Mode: modeFlat, BridgeName: "br-e"},
+		"ffff1": {Mode: modeRouted, BridgeName: "br-f"},
+		"gggg1": {Mode: modeMacvlan},
+		"hhhh1": {Mode: modeNAT},
+	}
+	want := [][]string{
+		isolationRule("br-a", "br-b"),
+		isolationRule("br-b", "br-a"),
+		isolationRule("br-b", "br-c"),
+		isolationRule("br-c", "br-b"),
+	}
+	if got := isolationRules(networks); !reflect.DeepEqual(got, want) {
+		t.Errorf("got rules\n%v\nwant\n%v", got, want)
+	}
+
+	// Allowing one way opens both
+	networks["bbbb1"].AllowNetworks = []string{"cccc1"}
+	want = [][]string{
+		isolationRule("br-a", "br-b"),
+		isolationRule("br-b", "br-a"),
+	}
+	if got := isolationRules(networks); !reflect.DeepEqual(got, want) {
+		t.Errorf("got rules\n%v\nwant\n%v", got, want)
+	}
+
+	if got := isolationRules(map[string]*NetworkState{"aaaa1": networks["aaaa1"]}); len(got) != 0 {
+		t.Errorf("got rules %v for a single network", got)
+	}
+}
+
+// fakeChain stands in for iptables, holding the rules of the isolation
+// chain. The jump to it is taken as there.
+type fakeChain struct {
+	rules []string
+}
+
+func (c *fakeChain) raw(args ...string) ([]byte, error) {
+	if args[0] == "-C" || args[0] == "-I" {
+		return nil, nil
+	}
+	op, rule := args[2], strings.Join(args[4:], " ")
+	switch op {
+	case "-S":
+		var out []string
+		for _, r := range c.rules {
+			out = append(out, "-A "+isolationChain+" "+r)
+		}
+		return []byte(strings.Join(out, "\n")), nil
+	case "-A":
+		c.rules = append(c.rules, rule)
+	case "-D":
+		for i, r := range c.rules {
+			if r == rule {
+				c.rules = append(c.rules[:i], c.rules[i+1:]...)
+				return nil, nil
+			}
+		}
+		return nil, fmt.Errorf("no rule %s", rule)
+	}
+	return nil, nil
+}
+
+func TestSyncIsolation(t *testing.T) {
+	ab := strings.Join(isolationRule("br-a", "br-b"), " ")
+	ba := strings.Join(isolationRule("br-b", "br-a"), " ")
+	// A copy of a rule and a stale one, as left by an earlier sync
+	chain := &fakeChain{rules: []string{ab, ab, strings.Join(isolationRule("br-a", "br-c"), " ")}}
+	want := [][]string{isolationRule("br-a", "br-b"), isolationRule("br-b", "br-a")}
+	if err := syncIsolation(chain.raw, want); err != nil {
+		t.Fatal(err)
+	}
+	if got := []string{ab, ba}; !reflect.DeepEqual(chain.rules, got) {
+		t.Errorf("got chain %v, want %v", chain.rules, got)
+	}
+
+	// Once allowed, no copy is left behind
+	if err := syncIsolation(chain.raw, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(chain.rules) != 0 {
+		t.Errorf("got chain %v, want it empty", chain.rules)
+	}
+}
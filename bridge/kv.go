@@ -0,0 +1,175 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errKeyNotFound = errors.New("key not found")
+	errKeyExists   = errors.New("key exists")
+)
+
+// kvStore holds the state the plugin instances of a cluster share: the
+// network definitions and the floating IP claims. Keys are slash separated
+// paths.
+type kvStore interface {
+	// Get returns errKeyNotFound when key is not there
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	// PutIfAbsent stores value only if key is not there yet and returns
+	// errKeyExists otherwise. Of two instances claiming the same key, only
+	// one succeeds.
+	PutIfAbsent(key string, value []byte) error
+	// Delete removes key, a missing key is not an error
+	Delete(key string) error
+	// List returns the keys right under prefix, a directory like key ending
+	// in a slash, and their values
+	List(prefix string) (map[string][]byte, error)
+}
+
+// newKVStore opens the cluster store at rawURL. Only file:// is built in,
+// pointing at a directory shared by the hosts or, for tests, a local one.
+func newKVStore(rawURL string) (kvStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster store %s: %s", rawURL, err)
+	}
+	switch u.Scheme {
+	case "file":
+		return newFileStore(u.Path)
+	default:
+		return nil, fmt.Errorf("unsupported cluster store %s", rawURL)
+	}
+}
+
+// fileStore keeps each key in a file of its own under a directory
+type fileStore struct {
+	dir string
+}
+
+func newFileStore(dir string) (*fileStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("file cluster store needs a directory")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+func (s *fileStore) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" || strings.Contains(key, "..") {
+		return "", fmt.Errorf("invalid key %s", key)
+	}
+	return filepath.Join(s.dir, clean), nil
+}
+
+func (s *fileStore) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, errKeyNotFound
+	}
+	return data, err
+}
+
+// Put writes through a temporary file and a rename so readers never see
+// half a value
+func (s *fileStore) Put(key string, value []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// PutIfAbsent relies on O_EXCL, which the filesystem makes atomic
+func (s *fileStore) PutIfAbsent(key string, value []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return errKeyExists
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(value); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+func (s *fileStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) List(prefix string) (map[string][]byte, error) {
+	dir, err := s.path(prefix)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return map[string][]byte{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte)
+	for _, info := range infos {
+		// Skip sub directories and the temporary files of Put
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[prefix+info.Name()] = data
+	}
+	return values, nil
+}
@@ -0,0 +1,139 @@
+package bridge
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// optionPrefix is the namespace of the driver's own options
+const optionPrefix = "bridge."
+
+// networkConfig holds the options of a network. Each field is read from the
+// option named in its tag, numbers are checked against the min and max tags.
+type networkConfig struct {
+	Name          string   `option:"bridge.name"`
+	MTU           int      `option:"bridge.mtu" min:"68" max:"65535"`
+	Mode          string   `option:"bridge.mode"`
+	BindInterface string   `option:"bridge.bind_interface"`
+	Vlan          int      `option:"bridge.vlan" min:"1" max:"4094"`
+	VxlanID       int      `option:"bridge.vxlan.vni" min:"1" max:"16777215"`
+	VxlanPeers    []string `option:"bridge.vxlan.peers"`
+	VxlanGroup    string   `option:"bridge.vxlan.group"`
+	VxlanPort     int      `option:"bridge.vxlan.port" min:"1" max:"65535"`
+	Internal      bool     `option:"bridge.internal"`
+	IPv6NAT       bool     `option:"bridge.ipv6_nat"`
+	AllowNetworks []string `option:"bridge.allow_networks"`
+	EnableICC     bool     `option:"bridge.enable_icc"`
+}
+
+// endpointConfig holds the options of an endpoint
+type endpointConfig struct {
+	Fip string `option:"bridge.fip"`
+}
+
+func parseNetworkConfig(options map[string]interface{}) (*networkConfig, error) {
+	c := &networkConfig{EnableICC: true}
+	if err := parseOptions(options, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func parseEndpointConfig(options map[string]interface{}) (*endpointConfig, error) {
+	c := &endpointConfig{}
+	if err := parseOptions(options, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseOptions fills config, a pointer to one of the structs above, from
+// the options docker passes. The -o options are nested under genericOption
+// and must all be known. At the top level, where docker keeps its own
+// options, only the keys in the driver's namespace are read.
+func parseOptions(options map[string]interface{}, config interface{}) error {
+	values := make(map[string]interface{})
+	for key, value := range options {
+		if strings.HasPrefix(key, optionPrefix) {
+			values[key] = value
+		}
+	}
+	if generic, ok := options[genericOption].(map[string]interface{}); ok {
+		for key, value := range generic {
+			values[key] = value
+		}
+	}
+
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	fields := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		fields[t.Field(i).Tag.Get("option")] = i
+	}
+	for key, value := range values {
+		i, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("unknown option %s", key)
+		}
+		if err := setOption(v.Field(i), t.Field(i), key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setOption coerces the value docker passed for an option, usually a
+// string, to the type of its field
+func setOption(field reflect.Value, spec reflect.StructField, key string, value interface{}) error {
+	var s string
+	switch value := value.(type) {
+	case string:
+		s = strings.TrimSpace(value)
+	case bool:
+		s = strconv.FormatBool(value)
+	case float64:
+		s = strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return fmt.Errorf("option %s has a value of unsupported type %T", key, value)
+	}
+	// An empty value leaves the default
+	if s == "" {
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		min, minErr := strconv.Atoi(spec.Tag.Get("min"))
+		max, maxErr := strconv.Atoi(spec.Tag.Get("max"))
+		if minErr != nil || maxErr != nil {
+			if err != nil {
+				return fmt.Errorf("option %s must be a number, got %q", key, s)
+			}
+		} else if err != nil || n < min || n > max {
+			return fmt.Errorf("option %s must be a number between %d and %d, got %q", key, min, max, s)
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("option %s must be true or false, got %q", key, s)
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("option %s has no parser for %s", key, field.Kind())
+	}
+	return nil
+}
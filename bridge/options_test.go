@@ -0,0 +1,130 @@
+package bridge
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]interface{}
+		want    networkConfig
+		err     bool
+	}{
+		{
+			name: "generic options",
+			options: map[string]interface{}{
+				genericOption: map[string]interface{}{
+					"bridge.name":        "br-test",
+					"bridge.mtu":         "9000",
+					"bridge.mode":        "flat",
+					"bridge.internal":    "true",
+					"bridge.vxlan.peers": " 10.0.0.1, ,10.0.0.2 ",
+				},
+			},
+			want: networkConfig{
+				Name:       "br-test",
+				MTU:        9000,
+				Mode:       "flat",
+				Internal:   true,
+				VxlanPeers: []string{"10.0.0.1", "10.0.0.2"},
+				EnableICC:  true,
+			},
+		},
+		{
+			name: "JSON values",
+			options: map[string]interface{}{
+				genericOption: map[string]interface{}{
+					"bridge.vlan":       float64(100),
+					"bridge.enable_icc": false,
+				},
+			},
+			want: networkConfig{Vlan: 100},
+		},
+		{
+			name: "top level options",
+			options: map[string]interface{}{
+				"com.docker.network.enable_ipv6": true,
+				"bridge.mode":                    "routed",
+			},
+			want: networkConfig{Mode: "routed", EnableICC: true},
+		},
+		{
+			name: "empty value keeps the default",
+			options: map[string]interface{}{
+				genericOption: map[string]interface{}{"bridge.enable_icc": "", "bridge.mtu": " "},
+			},
+			want: networkConfig{EnableICC: true},
+		},
+		{
+			name:    "unknown option",
+			options: map[string]interface{}{genericOption: map[string]interface{}{"bridge.nmae": "br0"}},
+			err:     true,
+		},
+		{
+			name:    "unknown top level option",
+			options: map[string]interface{}{"bridge.nmae": "br0"},
+			err:     true,
+		},
+		{
+			name:    "number below min",
+			options: map[string]interface{}{genericOption: map[string]interface{}{"bridge.mtu": "60"}},
+			err:     true,
+		},
+		{
+			name:    "number above max",
+			options: map[string]interface{}{genericOption: map[string]interface{}{"bridge.vlan": "4095"}},
+			err:     true,
+		},
+		{
+			name:    "not a number",
+			options: map[string]interface{}{genericOption: map[string]interface{}{"bridge.vxlan.vni": "one"}},
+			err:     true,
+		},
+		{
+			name:    "not a bool",
+			options: map[string]interface{}{genericOption: map[string]interface{}{"bridge.internal": "maybe"}},
+			err:     true,
+		},
+		{
+			name:    "unsupported type",
+			options: map[string]interface{}{genericOption: map[string]interface{}{"bridge.name": []interface{}{"br0"}}},
+			err:     true,
+		},
+	}
+	for _, test := range tests {
+		c, err := parseNetworkConfig(test.options)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.name, c)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*c, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, *c, test.want)
+		}
+	}
+}
+
+func TestParseEndpointOptions(t *testing.T) {
+	c, err := parseEndpointConfig(map[string]interface{}{
+		genericOption: map[string]interface{}{"bridge.fip": "10.0.2.200"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Fip != "10.0.2.200" {
+		t.Errorf("got floating IP %q, want 10.0.2.200", c.Fip)
+	}
+	// Network options are not endpoint options
+	if _, err := parseEndpointConfig(map[string]interface{}{
+		genericOption: map[string]interface{}{"bridge.mtu": "1500"},
+	}); err == nil {
+		t.Error("expected an error for a network option")
+	}
+}
@@ -0,0 +1,131 @@
+package bridge
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/chenleji/docker-bridge-plugin/dknet"
+)
+
+// hostAuxPrefix marks the auxiliary addresses that are given to the bridge.
+// IPAM keeps every auxiliary address away from the containers, the others
+// are left alone.
+const hostAuxPrefix = "host"
+
+// PoolState is one subnet of a network
+type PoolState struct {
+	Pool         string
+	Gateway      string
+	GatewayMask  string
+	AuxAddresses map[string]string
+}
+
+func (p PoolState) ipv6() bool {
+	return strings.Contains(p.Pool, ":") || strings.Contains(p.Gateway, ":")
+}
+
+func (p PoolState) gatewayCIDR() string {
+	return p.Gateway + "/" + p.GatewayMask
+}
+
+func (p PoolState) contains(ip net.IP) bool {
+	_, subnet, err := net.ParseCIDR(p.Pool)
+	if err != nil || ip == nil {
+		return false
+	}
+	return subnet.Contains(ip)
+}
+
+// hostAddresses returns the auxiliary addresses the host takes, in CIDR
+// form with the prefix length of the pool
+func (p PoolState) hostAddresses() []string {
+	_, subnet, err := net.ParseCIDR(p.Pool)
+	if err != nil {
+		return nil
+	}
+	ones, _ := subnet.Mask.Size()
+	var addrs []string
+	for name, ip := range p.AuxAddresses {
+		if strings.HasPrefix(name, hostAuxPrefix) {
+			addrs = append(addrs, fmt.Sprintf("%s/%d", ip, ones))
+		}
+	}
+	return addrs
+}
+
+// getPools reads every IPv4 and IPv6 subnet of a network
+func getPools(r *dknet.CreateNetworkRequest) ([]PoolState, error) {
+	var pools []PoolState
+	for _, data := range append(append([]*dknet.IPAMData{}, r.IPv4Data...), r.IPv6Data...) {
+		if data == nil {
+			continue
+		}
+		pool := PoolState{
+			Pool:         data.Pool,
+			AuxAddresses: make(map[string]string),
+		}
+		if data.Gateway != "" {
+			gateway, mask, err := splitGateway(data.Gateway)
+			if err != nil {
+				return nil, err
+			}
+			pool.Gateway, pool.GatewayMask = gateway, mask
+		}
+		for name, value := range data.AuxAddresses {
+			addr, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("auxiliary address %s of %s is not a string", name, data.Pool)
+			}
+			addr = strings.Split(addr, "/")[0]
+			if net.ParseIP(addr) == nil {
+				return nil, fmt.Errorf("auxiliary address %s of %s is not an IP address: %s", name, data.Pool, addr)
+			}
+			pool.AuxAddresses[name] = addr
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+// firstGateway returns the gateway of the first pool of a family that has
+// one, it is the network's default gateway
+func firstGateway(pools []PoolState, ipv6 bool) (string, string) {
+	for _, pool := range pools {
+		if pool.ipv6() == ipv6 && pool.Gateway != "" {
+			return pool.Gateway, pool.GatewayMask
+		}
+	}
+	return "", ""
+}
+
+// pools returns the subnets of a network. Networks saved before all pools
+// were kept only know their first gateway of each family.
+func (n *NetworkState) pools() []PoolState {
+	if len(n.Pools) > 0 {
+		return n.Pools
+	}
+	var pools []PoolState
+	if n.Gateway != "" {
+		pools = append(pools, PoolState{Gateway: n.Gateway, GatewayMask: n.GatewayMask})
+	}
+	if n.Gateway6 != "" {
+		pools = append(pools, PoolState{Gateway: n.Gateway6, GatewayMask: n.Gateway6Mask})
+	}
+	return pools
+}
+
+// gatewayFor picks the gateway of the pool an endpoint address is in,
+// falling back to the default gateway of its family
+func (n *NetworkState) gatewayFor(addr string) string {
+	ip := net.ParseIP(addr)
+	for _, pool := range n.pools() {
+		if pool.Gateway != "" && pool.contains(ip) {
+			return pool.Gateway
+		}
+	}
+	if ip != nil && ip.To4() == nil {
+		return n.Gateway6
+	}
+	return n.Gateway
+}
@@ -0,0 +1,253 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/libnetwork/iptables"
+)
+
+const (
+	// Endpoint options docker fills in from docker run -p and --expose
+	portMapOption      = "com.docker.network.portmap"
+	exposedPortsOption = "com.docker.network.endpoint.exposedports"
+
+	// -p without a host port gets one from the range docker's own port
+	// allocator uses
+	ephemeralPortStart = 49153
+	ephemeralPortEnd   = 65535
+)
+
+// protocolNames maps the IP protocol numbers docker sends to the names
+// iptables takes
+var protocolNames = map[int]string{
+	6:   "tcp",
+	17:  "udp",
+	132: "sctp",
+}
+
+// PortBinding is a port published with docker run -p. Like docker, a host
+// port range stands for one free port out of it, which is the only one kept
+// once the binding is reserved.
+type PortBinding struct {
+	Proto       int
+	IP          string
+	Port        int
+	HostIP      string
+	HostPort    int
+	HostPortEnd int
+}
+
+// TransportPort is a port exposed by the image or with docker run --expose
+type TransportPort struct {
+	Proto int
+	Port  int
+}
+
+func (b PortBinding) protocol() string {
+	return protocolNames[b.Proto]
+}
+
+func (b PortBinding) String() string {
+	hostIP := b.HostIP
+	if hostIP == "" {
+		hostIP = "0.0.0.0"
+	}
+	return fmt.Sprintf("%s/%s:%d->%d", b.protocol(), hostIP, b.HostPort, b.Port)
+}
+
+// overlaps tells whether two reserved bindings take the same host port
+func (b PortBinding) overlaps(o PortBinding) bool {
+	if b.Proto != o.Proto || (!anyHostIP(b.HostIP) && !anyHostIP(o.HostIP) && b.HostIP != o.HostIP) {
+		return false
+	}
+	return b.HostPort == o.HostPort
+}
+
+func anyHostIP(ip string) bool {
+	return ip == "" || net.ParseIP(ip).IsUnspecified()
+}
+
+// decodeOption reads an option docker sends as a JSON structure into out
+func decodeOption(options map[string]interface{}, key string, out interface{}) error {
+	value, ok := options[key]
+	if !ok || value == nil {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("invalid %s option: %s", key, err)
+	}
+	return nil
+}
+
+// getPortBindings reads and checks the published ports of an endpoint
+func getPortBindings(options map[string]interface{}) ([]PortBinding, error) {
+	var bindings []PortBinding
+	if err := decodeOption(options, portMapOption, &bindings); err != nil {
+		return nil, err
+	}
+	for _, b := range bindings {
+		if b.protocol() == "" {
+			return nil, fmt.Errorf("port %d has unsupported protocol %d", b.Port, b.Proto)
+		}
+		if !anyHostIP(b.HostIP) && net.ParseIP(b.HostIP).To4() == nil {
+			return nil, fmt.Errorf("port %d can only be published on an IPv4 address, not %s", b.Port, b.HostIP)
+		}
+	}
+	return bindings, nil
+}
+
+func getExposedPorts(options map[string]interface{}) ([]TransportPort, error) {
+	var ports []TransportPort
+	if err := decodeOption(options, exposedPortsOption, &ports); err != nil {
+		return nil, err
+	}
+	return ports, nil
+}
+
+// reservePorts picks the host port of every binding, the first free one of
+// its range or of the ephemeral range when it has none, and stores them on
+// ep. Endpoints get registered here rather than
+// after, so that no other endpoint can take the ports in between.
+func (d *Driver) reservePorts(endpointID string, ep *EndpointState, bindings []PortBinding) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var taken []PortBinding
+	for id, other := range d.endpoints {
+		if id != endpointID {
+			taken = append(taken, other.Ports...)
+		}
+	}
+	free := func(b PortBinding) bool {
+		for _, t := range taken {
+			if b.overlaps(t) {
+				return false
+			}
+		}
+		return true
+	}
+
+	resolved := make([]PortBinding, 0, len(bindings))
+	for _, b := range bindings {
+		first, last := b.HostPort, b.HostPortEnd
+		if first == 0 {
+			first, last = ephemeralPortStart, ephemeralPortEnd
+		} else if last < first {
+			last = first
+		}
+		b.HostPort, b.HostPortEnd = 0, 0
+		for port := first; port <= last; port++ {
+			if b.HostPort = port; free(b) {
+				break
+			}
+			b.HostPort = 0
+		}
+		if b.HostPort == 0 && first == last {
+			return fmt.Errorf("host port %s/%d is already published", b.protocol(), first)
+		} else if b.HostPort == 0 {
+			return fmt.Errorf("no free host port left in %d-%d for %s/%d", first, last, b.protocol(), b.Port)
+		}
+		taken = append(taken, b)
+		resolved = append(resolved, b)
+	}
+	ep.Ports = resolved
+	d.endpoints[endpointID] = ep
+	return nil
+}
+
+// portDnatRule forwards the host ports of a binding to the container, the
+// same way addFipDnat forwards a floating IP
+func portDnatRule(b PortBinding, lipStr string, intfName string) []string {
+	rule := []string{"DOCKER", "-t", "nat"}
+	if !anyHostIP(b.HostIP) {
+		rule = append(rule, "-d", b.HostIP)
+	}
+	return append(rule,
+		"!", "-i", intfName,
+		"-p", b.protocol(), "-m", b.protocol(), "--dport", strconv.Itoa(b.HostPort),
+		"-m", "comment", "--comment", ruleComment,
+		"-j", "DNAT", "--to-destination", net.JoinHostPort(lipStr, strconv.Itoa(b.Port)),
+	)
+}
+
+func addPortDnat(b PortBinding, lipStr string, intfName string) error {
+	rule := portDnatRule(b, lipStr, intfName)
+	if _, err := iptables.Raw(append([]string{"-C"}, rule...)...); err == nil {
+		return nil
+	}
+	if output, err := iptables.Raw(append([]string{"-I"}, rule...)...); err != nil {
+		return err
+	} else if len(output) > 0 {
+		return &iptables.ChainError{
+			Chain:  "DOCKER",
+			Output: output,
+		}
+	}
+	log.Debugf("Published port [ %s ] of [ %s ]", b, lipStr)
+	return nil
+}
+
+func delPortDnat(b PortBinding, lipStr string, intfName string) error {
+	rule := portDnatRule(b, lipStr, intfName)
+	if _, err := iptables.Raw(append([]string{"-C"}, rule...)...); err != nil {
+		log.Debugf("Published port [ %s ] of [ %s ] has no DNAT rule", b, lipStr)
+		return nil
+	}
+	if output, err := iptables.Raw(append([]string{"-D"}, rule...)...); err != nil {
+		return err
+	} else if len(output) > 0 {
+		return &iptables.ChainError{
+			Chain:  "DOCKER",
+			Output: output,
+		}
+	}
+	return nil
+}
+
+// publishPorts adds the DNAT rules of an endpoint, removing those it added
+// if one fails
+func publishPorts(ep *EndpointState, intfName string) error {
+	for i, b := range ep.Ports {
+		if err := addPortDnat(b, ep.Lip, intfName); err != nil {
+			for _, added := range ep.Ports[:i] {
+				delPortDnat(added, ep.Lip, intfName)
+			}
+			return fmt.Errorf("could not publish port %s: %s", b, err)
+		}
+	}
+	return nil
+}
+
+// unpublishPorts removes the DNAT rules of an endpoint
+func unpublishPorts(ep *EndpointState, intfName string) {
+	for _, b := range ep.Ports {
+		if err := delPortDnat(b, ep.Lip, intfName); err != nil {
+			log.Errorf("Could not unpublish port [ %s ]: %s", b, err)
+		}
+	}
+}
+
+// formatPorts lists the published ports for EndpointInfo
+func formatPorts(bindings []PortBinding) string {
+	var ports []string
+	for _, b := range bindings {
+		ports = append(ports, b.String())
+	}
+	return strings.Join(ports, ",")
+}
+
+func formatExposedPorts(ports []TransportPort) string {
+	var list []string
+	for _, p := range ports {
+		list = append(list, fmt.Sprintf("%s/%d", protocolNames[p.Proto], p.Port))
+	}
+	return strings.Join(list, ",")
+}
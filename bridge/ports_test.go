@@ -0,0 +1,150 @@
+package bridge
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestPortBindingOverlaps(t *testing.T) {
+	tcp80 := PortBinding{Proto: 6, Port: 80, HostPort: 8080}
+	tests := []struct {
+		name string
+		a, b PortBinding
+		want bool
+	}{
+		{"same port", tcp80, PortBinding{Proto: 6, Port: 81, HostPort: 8080}, true},
+		{"other port", tcp80, PortBinding{Proto: 6, Port: 80, HostPort: 8081}, false},
+		{"other protocol", tcp80, PortBinding{Proto: 17, Port: 80, HostPort: 8080}, false},
+		{"any address and one address", tcp80, PortBinding{Proto: 6, HostIP: "10.0.0.1", HostPort: 8080}, true},
+		{"unspecified address", PortBinding{Proto: 6, HostIP: "0.0.0.0", HostPort: 8080}, PortBinding{Proto: 6, HostIP: "10.0.0.1", HostPort: 8080}, true},
+		{"same address", PortBinding{Proto: 6, HostIP: "10.0.0.1", HostPort: 8080}, PortBinding{Proto: 6, HostIP: "10.0.0.1", HostPort: 8080}, true},
+		{"other address", PortBinding{Proto: 6, HostIP: "10.0.0.1", HostPort: 8080}, PortBinding{Proto: 6, HostIP: "10.0.0.2", HostPort: 8080}, false},
+	}
+	for _, test := range tests {
+		if got := test.a.overlaps(test.b); got != test.want {
+			t.Errorf("%s: %s overlaps %s is %v, want %v", test.name, test.a, test.b, got, test.want)
+		}
+		if got := test.b.overlaps(test.a); got != test.want {
+			t.Errorf("%s: %s overlaps %s is %v, want %v", test.name, test.b, test.a, got, test.want)
+		}
+	}
+}
+
+func TestReservePorts(t *testing.T) {
+	d := &Driver{endpoints: map[string]*EndpointState{
+		"other": {Ports: []PortBinding{
+			{Proto: 6, Port: 80, HostPort: ephemeralPortStart},
+			{Proto: 6, Port: 80, HostPort: 9000},
+			{Proto: 6, Port: 80, HostPort: 9001},
+			{Proto: 17, Port: 53, HostIP: "10.0.0.1", HostPort: 5353},
+		}},
+	}}
+	tests := []struct {
+		name     string
+		bindings []PortBinding
+		want     []PortBinding
+	}{
+		{
+			name:     "ephemeral port",
+			bindings: []PortBinding{{Proto: 6, Port: 80}, {Proto: 6, Port: 443}},
+			want:     []PortBinding{{Proto: 6, Port: 80, HostPort: ephemeralPortStart + 1}, {Proto: 6, Port: 443, HostPort: ephemeralPortStart + 2}},
+		},
+		{
+			name:     "first free port of a range",
+			bindings: []PortBinding{{Proto: 6, Port: 90, HostPort: 9000, HostPortEnd: 9010}},
+			want:     []PortBinding{{Proto: 6, Port: 90, HostPort: 9002}},
+		},
+		{
+			name:     "fixed port",
+			bindings: []PortBinding{{Proto: 6, Port: 80, HostPort: 8080}, {Proto: 17, Port: 80, HostPort: 9000}},
+			want:     []PortBinding{{Proto: 6, Port: 80, HostPort: 8080}, {Proto: 17, Port: 80, HostPort: 9000}},
+		},
+		{
+			name:     "port on another address",
+			bindings: []PortBinding{{Proto: 17, Port: 53, HostIP: "10.0.0.2", HostPort: 5353}},
+			want:     []PortBinding{{Proto: 17, Port: 53, HostIP: "10.0.0.2", HostPort: 5353}},
+		},
+		{
+			name:     "fixed port taken",
+			bindings: []PortBinding{{Proto: 6, Port: 80, HostPort: 9000}},
+		},
+		{
+			name:     "port taken on the same address",
+			bindings: []PortBinding{{Proto: 17, Port: 53, HostPort: 5353}},
+		},
+		{
+			name:     "range taken",
+			bindings: []PortBinding{{Proto: 6, Port: 80, HostPort: 9000, HostPortEnd: 9001}},
+		},
+		{
+			name:     "port twice in one endpoint",
+			bindings: []PortBinding{{Proto: 6, Port: 80, HostPort: 8080}, {Proto: 6, Port: 81, HostPort: 8080}},
+		},
+	}
+	for _, test := range tests {
+		ep := &EndpointState{}
+		err := d.reservePorts("new", ep, test.bindings)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.name, ep.Ports)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(ep.Ports, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, ep.Ports, test.want)
+		}
+		if d.endpoints["new"] != ep {
+			t.Errorf("%s: endpoint not registered", test.name)
+		}
+		delete(d.endpoints, "new")
+	}
+
+	// An endpoint reserving again does not clash with itself
+	ep := d.endpoints["other"]
+	if err := d.reservePorts("other", ep, ep.Ports); err != nil {
+		t.Errorf("reserving the ports of an endpoint again: %s", err)
+	}
+}
+
+func TestReservePortsConcurrently(t *testing.T) {
+	d := &Driver{endpoints: make(map[string]*EndpointState)}
+	const endpoints = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, endpoints)
+	for i := 0; i < endpoints; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			errs <- d.reservePorts(id, &EndpointState{}, []PortBinding{
+				{Proto: 6, Port: 80},
+				{Proto: 6, Port: 90, HostPort: 9000, HostPortEnd: 9000 + endpoints - 1},
+			})
+		}(fmt.Sprintf("ep%d", i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[int]string)
+	for id, ep := range d.endpoints {
+		for _, b := range ep.Ports {
+			if other, ok := seen[b.HostPort]; ok {
+				t.Errorf("host port %d given to %s and %s", b.HostPort, other, id)
+			}
+			seen[b.HostPort] = id
+		}
+	}
+	if len(seen) != 2*endpoints {
+		t.Errorf("got %d host ports, want %d", len(seen), 2*endpoints)
+	}
+}
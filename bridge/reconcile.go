@@ -0,0 +1,266 @@
+package bridge
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/chenleji/docker-bridge-plugin/dknet"
+	"github.com/vishvananda/netlink"
+)
+
+// Reconcile brings the driver state in line with the networks and
+// containers the docker daemon knows about and with what is programmed on
+// the host. It is run once when the plugin starts, alongside the requests:
+// docker may be restoring containers that need the plugin, so it is asked
+// first and requests are only held up while the answer is applied.
+func (d *Driver) Reconcile() error {
+	snap := d.snapshot()
+	networks, err := d.listNetworks(d.name)
+	if err != nil {
+		return fmt.Errorf("could not list docker networks: %s", err)
+	}
+	// The containers of endpoints the driver lost are inspected now, the
+	// requests must not wait on docker
+	for _, n := range networks {
+		for containerID, c := range n.Containers {
+			if snap.endpoints[c.EndpointID] {
+				continue
+			}
+			container, err := d.inspectContainer(containerID)
+			if err != nil {
+				log.Warnf("Could not inspect container [ %s ]: %s", containerID, err)
+				continue
+			}
+			snap.containers[containerID] = container
+		}
+	}
+
+	d.opLock.Lock()
+	defer d.opLock.Unlock()
+	known := make(map[string]bool)
+	for _, n := range networks {
+		known[n.Id] = true
+	}
+
+	for _, id := range d.networkIDs() {
+		if !known[id] && snap.networks[id] {
+			log.Infof("Network [ %s ] is gone from docker, removing it", id)
+			d.removeNetwork(id)
+		}
+	}
+	for _, n := range networks {
+		if err := d.reconcileNetwork(n, snap); err != nil {
+			log.Errorf("Could not reconcile network [ %s ]: %s", n.Id, err)
+		}
+	}
+	return nil
+}
+
+// reconcileSnapshot is what the driver knew when Reconcile asked docker.
+// Requests are served until the answer is applied, whatever they added or
+// removed in between is newer than the answer and is left alone.
+type reconcileSnapshot struct {
+	networks   map[string]bool
+	endpoints  map[string]bool
+	containers map[string]*containerInfo
+}
+
+func (d *Driver) snapshot() *reconcileSnapshot {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	snap := &reconcileSnapshot{
+		networks:   make(map[string]bool),
+		endpoints:  make(map[string]bool),
+		containers: make(map[string]*containerInfo),
+	}
+	for id := range d.networks {
+		snap.networks[id] = true
+	}
+	for id := range d.endpoints {
+		snap.endpoints[id] = true
+	}
+	return snap
+}
+
+func (d *Driver) reconcileNetwork(n *networkInfo, snap *reconcileSnapshot) error {
+	if _, err := d.getNetwork(n.Id); err == nil {
+		log.Debugf("Checking bridge of network [ %s ]", n.Id)
+		unlock := d.netLock(n.Id)
+		err := d.initBridge(n.Id, true)
+		unlock()
+		if err != nil {
+			return err
+		}
+	} else if snap.networks[n.Id] {
+		log.Debugf("Network [ %s ] was deleted since docker was asked", n.Id)
+		return nil
+	} else {
+		log.Infof("Rebuilding state of network [ %s ] from docker", n.Id)
+		if err := d.createNetwork(networkRequest(n), true); err != nil {
+			return err
+		}
+	}
+
+	attached := make(map[string]string)
+	for containerID, c := range n.Containers {
+		attached[c.EndpointID] = containerID
+	}
+	for _, id := range d.endpointIDs(n.Id) {
+		if _, ok := attached[id]; !ok && snap.endpoints[id] {
+			log.Infof("Endpoint [ %s ] is gone from docker, removing it", id)
+			d.removeEndpoint(n.Id, id)
+		}
+	}
+	for containerID, c := range n.Containers {
+		if err := d.reconcileEndpoint(n.Id, containerID, c, snap); err != nil {
+			log.Errorf("Could not reconcile endpoint [ %s ]: %s", c.EndpointID, err)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) reconcileEndpoint(networkID, containerID string, info endpointInfo, snap *reconcileSnapshot) error {
+	endpointID, address := info.EndpointID, info.IPv4Address
+	unlock := d.netLock(networkID)
+	defer unlock()
+	defer d.saveState(networkID)
+
+	network, err := d.getNetwork(networkID)
+	if err != nil {
+		return err
+	}
+	if _, err := d.getEndpoint(endpointID); err != nil && snap.endpoints[endpointID] {
+		log.Debugf("Endpoint [ %s ] was deleted since docker was asked", endpointID)
+		return nil
+	}
+	// Child links live in the container namespace, there is nothing to
+	// check on the host
+	if !isChildMode(network.Mode) {
+		if err := reconcileVeth(network, endpointID, containerID, address); err != nil {
+			return err
+		}
+	}
+
+	ep, err := d.getEndpoint(endpointID)
+	if err != nil {
+		log.Infof("Rebuilding state of endpoint [ %s ] of container [ %s ]", endpointID, containerID)
+		ep = &EndpointState{
+			NetworkID: networkID,
+			Container: containerID,
+			Lip:       strings.Split(address, "/")[0],
+			Lip6:      strings.Split(info.IPv6Address, "/")[0],
+			Mac:       info.MacAddress,
+		}
+		d.setEndpoint(endpointID, ep)
+		request := ""
+		if container := snap.containers[containerID]; container != nil {
+			ep.SandboxKey = container.NetworkSettings.SandboxKey
+			request = container.Config.Labels[fipOption]
+		}
+		if !supportsFips(network) {
+			ep.FipRequest = fipNone
+			return nil
+		}
+		return d.assignFip(endpointID, request, network.BridgeName)
+	}
+
+	if ep.Fip != "" && ep.FipIfName != "" {
+		// setInterfaceIP fails when the address is still there
+		if !ifaceHasAddr(ep.FipIfName, net.ParseIP(ep.Fip)) {
+			if err := setInterfaceIP(ep.FipIfName, ep.Fip+"/32"); err != nil {
+				return err
+			}
+		}
+		if err := addFipDnat(ep.Fip, ep.Lip, network.BridgeName); err != nil {
+			return err
+		}
+	}
+	if ep.SandboxKey != "" {
+		return publishPorts(ep, network.BridgeName)
+	}
+	return nil
+}
+
+// reconcileVeth puts the host end of an endpoint's veth back in place
+func reconcileVeth(network *NetworkState, endpointID, containerID, address string) error {
+	localVethPair := vethPair(truncateID(endpointID))
+	link, err := netlink.LinkByName(localVethPair.Name)
+	if err != nil {
+		return fmt.Errorf("veth %s of container %s is missing", localVethPair.Name, containerID)
+	}
+	if network.MTU > 0 && link.Attrs().MTU != network.MTU {
+		log.Warnf("Veth [ %s ] has MTU [ %d ] instead of [ %d ]", localVethPair.Name, link.Attrs().MTU, network.MTU)
+	}
+	if network.Mode == modeRouted {
+		return addEndpointRoute(network, localVethPair.Name, strings.Split(address, "/")[0])
+	}
+	bridge, err := netlink.LinkByName(network.BridgeName)
+	if err != nil {
+		return err
+	}
+	if link.Attrs().MasterIndex != bridge.Attrs().Index {
+		log.Infof("Attaching veth [ %s ] to bridge [ %s ] again", localVethPair.Name, network.BridgeName)
+		if err := netlink.LinkSetMasterByIndex(link, bridge.Attrs().Index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeNetwork tears down a network docker no longer knows about
+func (d *Driver) removeNetwork(id string) {
+	for _, epID := range d.endpointIDs(id) {
+		d.removeEndpoint(id, epID)
+	}
+	if err := d.deleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: id}); err != nil {
+		log.Warnf("Could not delete network [ %s ]: %s", id, err)
+		d.setNetwork(id, nil)
+		d.saveState(id)
+	}
+}
+
+// removeEndpoint tears down an endpoint docker no longer knows about
+func (d *Driver) removeEndpoint(networkID, endpointID string) {
+	if err := d.leave(&dknet.LeaveRequest{NetworkID: networkID, EndpointID: endpointID}); err != nil {
+		log.Debugf("Leave of stale endpoint [ %s ] failed: %s", endpointID, err)
+	}
+	d.deleteEndpoint(&dknet.DeleteEndpointRequest{NetworkID: networkID, EndpointID: endpointID})
+}
+
+// networkRequest builds the create request docker would have sent for n
+func networkRequest(n *networkInfo) *dknet.CreateNetworkRequest {
+	generic := make(map[string]interface{})
+	for k, v := range n.Options {
+		generic[k] = v
+	}
+	r := &dknet.CreateNetworkRequest{
+		NetworkID: n.Id,
+		Options:   map[string]interface{}{genericOption: generic},
+	}
+	if n.Internal {
+		r.Options[dockerInternalOption] = true
+	}
+	for _, c := range n.IPAM.Config {
+		gateway := c.Gateway
+		if _, subnet, err := net.ParseCIDR(c.Subnet); err == nil && !strings.Contains(gateway, "/") {
+			ones, _ := subnet.Mask.Size()
+			gateway = fmt.Sprintf("%s/%d", gateway, ones)
+		}
+		data := &dknet.IPAMData{
+			Pool:         c.Subnet,
+			Gateway:      gateway,
+			AuxAddresses: make(map[string]interface{}),
+		}
+		for k, v := range c.AuxAddress {
+			data.AuxAddresses[k] = v
+		}
+		if strings.Contains(c.Subnet, ":") {
+			r.IPv6Data = append(r.IPv6Data, data)
+		} else {
+			r.IPv4Data = append(r.IPv4Data, data)
+		}
+	}
+	return r
+}
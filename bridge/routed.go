@@ -0,0 +1,97 @@
+package bridge
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// In routed mode the bridge only holds the gateway address. Endpoints are
+// not enslaved to it: each container is reached through a /32 route on its
+// veth, the veth answers ARP for the rest of the subnet, and the host
+// answers ARP for the containers on the bind interface so that upstream
+// routers reach them without any NAT.
+
+// addEndpointRoute sets up the host side of a routed endpoint
+func addEndpointRoute(network *NetworkState, vethName string, lip string) error {
+	ip := net.ParseIP(lip)
+	if ip == nil || ip.To4() == nil {
+		return fmt.Errorf("endpoint address %q is not IPv4", lip)
+	}
+	veth, err := netlink.LinkByName(vethName)
+	if err != nil {
+		return err
+	}
+	if err := setSysctl("net/ipv4/conf/"+vethName+"/proxy_arp", "1"); err != nil {
+		return err
+	}
+
+	route := &netlink.Route{
+		LinkIndex: veth.Attrs().Index,
+		Scope:     netlink.SCOPE_LINK,
+		Dst:       &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)},
+	}
+	if err := netlink.RouteAdd(route); err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("could not add route to %s via %s: %s", lip, vethName, err)
+	}
+	log.Debugf("Added route [ %s/32 ] via [ %s ]", lip, vethName)
+
+	if network.FlatBindInterface == "" {
+		return nil
+	}
+	nic, err := netlink.LinkByName(network.FlatBindInterface)
+	if err != nil {
+		return fmt.Errorf("bind interface %s not found: %s", network.FlatBindInterface, err)
+	}
+	if err := netlink.NeighSet(proxyNeigh(nic, ip)); err != nil {
+		return fmt.Errorf("could not proxy ARP for %s on %s: %s", lip, network.FlatBindInterface, err)
+	}
+	log.Debugf("Answering ARP for [ %s ] on [ %s ]", lip, network.FlatBindInterface)
+	return nil
+}
+
+// delEndpointRoute undoes addEndpointRoute. The route goes away with the
+// veth, so only the proxy entry is removed when the veth is already gone.
+func delEndpointRoute(network *NetworkState, vethName string, lip string) {
+	ip := net.ParseIP(lip)
+	if ip == nil || ip.To4() == nil {
+		return
+	}
+	if veth, err := netlink.LinkByName(vethName); err == nil {
+		route := &netlink.Route{
+			LinkIndex: veth.Attrs().Index,
+			Scope:     netlink.SCOPE_LINK,
+			Dst:       &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)},
+		}
+		if err := netlink.RouteDel(route); err != nil {
+			log.Debugf("Could not delete route [ %s/32 ] via [ %s ]: %s", lip, vethName, err)
+		}
+	}
+
+	if network.FlatBindInterface == "" {
+		return
+	}
+	nic, err := netlink.LinkByName(network.FlatBindInterface)
+	if err != nil {
+		return
+	}
+	if err := netlink.NeighDel(proxyNeigh(nic, ip)); err != nil {
+		log.Debugf("Could not delete proxy ARP entry [ %s ] on [ %s ]: %s", lip, network.FlatBindInterface, err)
+	}
+}
+
+// proxyNeigh is the entry that makes the host answer ARP for ip on link.
+// The kernel ignores the MAC of proxy entries but refuses a short one, and
+// netlink always sends it.
+func proxyNeigh(link netlink.Link, ip net.IP) *netlink.Neigh {
+	return &netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       netlink.FAMILY_V4,
+		Flags:        netlink.NTF_PROXY,
+		IP:           ip.To4(),
+		HardwareAddr: link.Attrs().HardwareAddr,
+	}
+}
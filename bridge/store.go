@@ -0,0 +1,124 @@
+package bridge
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const stateFileName = "state.json"
+
+// driverState is what gets written to disk
+type driverState struct {
+	Networks  map[string]*NetworkState
+	Endpoints map[string]*EndpointState
+}
+
+// copy returns a deep copy of the state
+func (s *driverState) copy() *driverState {
+	c := &driverState{
+		Networks:  make(map[string]*NetworkState),
+		Endpoints: make(map[string]*EndpointState),
+	}
+	for id, ns := range s.Networks {
+		n := *ns
+		c.Networks[id] = &n
+	}
+	for id, ep := range s.Endpoints {
+		e := *ep
+		c.Endpoints[id] = &e
+	}
+	return c
+}
+
+// update replaces the saved copy of one network and its endpoints with the
+// live state. Endpoints never change network, so only the endpoints of
+// networkID are read.
+func (s *driverState) update(networkID string, networks map[string]*NetworkState, endpoints map[string]*EndpointState) {
+	if ns, ok := networks[networkID]; ok {
+		n := *ns
+		s.Networks[networkID] = &n
+	} else {
+		delete(s.Networks, networkID)
+	}
+	for id, ep := range s.Endpoints {
+		if ep.NetworkID == networkID {
+			delete(s.Endpoints, id)
+		}
+	}
+	for id, ep := range endpoints {
+		if ep.NetworkID == networkID {
+			e := *ep
+			s.Endpoints[id] = &e
+		}
+	}
+}
+
+// stateStore keeps the driver state in a JSON file so that it survives
+// plugin restarts. Every save rewrites the whole file through a temporary
+// file and a rename, so a crash never leaves a half written state behind.
+type stateStore struct {
+	path string
+}
+
+func newStateStore(dir string) (*stateStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &stateStore{path: filepath.Join(dir, stateFileName)}, nil
+}
+
+// load returns the saved state, or an empty one if nothing was saved yet
+func (s *stateStore) load() (*driverState, error) {
+	state := &driverState{
+		Networks:  make(map[string]*NetworkState),
+		Endpoints: make(map[string]*EndpointState),
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Networks == nil {
+		state.Networks = make(map[string]*NetworkState)
+	}
+	if state.Endpoints == nil {
+		state.Endpoints = make(map[string]*EndpointState)
+	}
+	log.Debugf("Loaded %d networks and %d endpoints from [ %s ]", len(state.Networks), len(state.Endpoints), s.path)
+	return state, nil
+}
+
+func (s *stateStore) save(state *driverState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), stateFileName+".")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
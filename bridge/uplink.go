@@ -0,0 +1,188 @@
+package bridge
+
+import (
+	"fmt"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// attachUplink enslaves a host NIC to the bridge. In flat mode the NIC's
+// addresses and routes move to the bridge with it so the host keeps its
+// connectivity, and the bridge takes over the NIC's MAC so that neighbours
+// keep reaching the host through their ARP caches.
+func attachUplink(bridgeName, ifaceName string, moveL3 bool) error {
+	br, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return err
+	}
+	nic, err := netlink.LinkByName(ifaceName)
+	if err != nil {
+		return fmt.Errorf("bind interface %s not found: %s", ifaceName, err)
+	}
+	if master := nic.Attrs().MasterIndex; master != 0 {
+		if master == br.Attrs().Index {
+			log.Debugf("Interface [ %s ] is already attached to bridge [ %s ]", ifaceName, bridgeName)
+			return nil
+		}
+		return fmt.Errorf("interface %s is already enslaved to another device", ifaceName)
+	}
+
+	if moveL3 {
+		if err := netlink.LinkSetHardwareAddr(br, nic.Attrs().HardwareAddr); err != nil {
+			return fmt.Errorf("could not give bridge %s the MAC of %s: %s", bridgeName, ifaceName, err)
+		}
+	}
+	if err := netlink.LinkSetUp(br); err != nil {
+		return err
+	}
+	if err := netlink.LinkSetUp(nic); err != nil {
+		return err
+	}
+	if err := netlink.LinkSetMasterByIndex(nic, br.Attrs().Index); err != nil {
+		return fmt.Errorf("could not attach %s to bridge %s: %s", ifaceName, bridgeName, err)
+	}
+	log.Infof("Attached interface [ %s ] to bridge [ %s ]", ifaceName, bridgeName)
+
+	if !moveL3 {
+		return nil
+	}
+	if err := moveAddrsAndRoutes(nic, br); err != nil {
+		log.Errorf("Moving addresses from [ %s ] to [ %s ] failed, moving them back: %s", ifaceName, bridgeName, err)
+		if rerr := moveAddrsAndRoutes(br, nic); rerr != nil {
+			log.Errorf("Could not move addresses back to [ %s ]: %s", ifaceName, rerr)
+		}
+		netlink.LinkSetNoMaster(nic)
+		return err
+	}
+	return nil
+}
+
+// vlanInterfaceName names the 802.1Q subinterface of parent for vlanID,
+// falling back to a name derived from the network when parent.vlanID does
+// not fit in IFNAMSIZ
+func vlanInterfaceName(parent string, vlanID int, networkID string) string {
+	name := fmt.Sprintf("%s.%d", parent, vlanID)
+	if len(name) > 15 {
+		name = fmt.Sprintf("vl%d-%s", vlanID, truncateID(networkID))
+	}
+	return name
+}
+
+// createVlan adds an 802.1Q subinterface to parent for a network. It is
+// reused if it is already there and was created for the network, a
+// subinterface made by hand is left alone as it would be deleted with the
+// network.
+func createVlan(parent string, name string, vlanID int, networkID string) error {
+	if link, err := netlink.LinkByName(name); err == nil {
+		if vlan, ok := link.(*netlink.Vlan); ok && vlan.VlanId == vlanID && link.Attrs().Alias == bridgeAliasPrefix+networkID {
+			log.Debugf("Reusing vlan interface [ %s ]", name)
+			return nil
+		}
+		return fmt.Errorf("interface %s already exists and is not the vlan %d interface of network %s", name, vlanID, networkID)
+	}
+	nic, err := netlink.LinkByName(parent)
+	if err != nil {
+		return fmt.Errorf("bind interface %s not found: %s", parent, err)
+	}
+	vlan := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        name,
+			ParentIndex: nic.Attrs().Index,
+		},
+		VlanId: vlanID,
+	}
+	if err := netlink.LinkAdd(vlan); err != nil {
+		return fmt.Errorf("could not create vlan interface %s: %s", name, err)
+	}
+	if err := setIfaceAlias(name, bridgeAliasPrefix+networkID); err != nil {
+		netlink.LinkDel(vlan)
+		return fmt.Errorf("could not mark vlan interface %s: %s", name, err)
+	}
+	if err := netlink.LinkSetUp(nic); err != nil {
+		return err
+	}
+	log.Infof("Created vlan interface [ %s ] with id [ %d ] on [ %s ]", name, vlanID, parent)
+	return nil
+}
+
+// deleteLink removes a link by name, a missing link is not an error
+func deleteLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil
+	}
+	return netlink.LinkDel(link)
+}
+
+// detachUplink releases a NIC from the bridge, handing back the addresses
+// and routes attachUplink moved over
+func detachUplink(bridgeName, ifaceName string, moveL3 bool) error {
+	nic, err := netlink.LinkByName(ifaceName)
+	if err != nil {
+		return fmt.Errorf("bind interface %s not found: %s", ifaceName, err)
+	}
+	if err := netlink.LinkSetNoMaster(nic); err != nil {
+		return fmt.Errorf("could not detach %s from bridge %s: %s", ifaceName, bridgeName, err)
+	}
+	log.Infof("Detached interface [ %s ] from bridge [ %s ]", ifaceName, bridgeName)
+	if !moveL3 {
+		return nil
+	}
+	br, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return err
+	}
+	return moveAddrsAndRoutes(br, nic)
+}
+
+// moveAddrsAndRoutes moves the addresses and the routes of one link to
+// another. Addresses are added to the new link before they are taken off the
+// old one, then the routes the kernel dropped with them are added back.
+// Link local IPv6 addresses and connected routes belong to the link and
+// stay where they are.
+func moveAddrsAndRoutes(from, to netlink.Link) error {
+	var routes []netlink.Route
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		list, err := netlink.RouteList(from, family)
+		if err != nil {
+			return err
+		}
+		for _, route := range list {
+			if route.Protocol == syscall.RTPROT_KERNEL {
+				continue
+			}
+			routes = append(routes, route)
+		}
+	}
+
+	addrs, err := netlink.AddrList(from, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		moved := &netlink.Addr{IPNet: addr.IPNet}
+		if err := netlink.AddrAdd(to, moved); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("could not add %s to %s: %s", addr.IPNet, to.Attrs().Name, err)
+		}
+		if err := netlink.AddrDel(from, moved); err != nil {
+			return fmt.Errorf("could not delete %s from %s: %s", addr.IPNet, from.Attrs().Name, err)
+		}
+		log.Debugf("Moved address [ %s ] from [ %s ] to [ %s ]", addr.IPNet, from.Attrs().Name, to.Attrs().Name)
+	}
+
+	for _, route := range routes {
+		// The route may have survived the address move
+		netlink.RouteDel(&route)
+		route.LinkIndex = to.Attrs().Index
+		if err := netlink.RouteAdd(&route); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("could not move route %s to %s: %s", route, to.Attrs().Name, err)
+		}
+		log.Debugf("Moved route [ %s ] to [ %s ]", route, to.Attrs().Name)
+	}
+	return nil
+}
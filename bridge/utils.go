@@ -2,17 +2,17 @@ package bridge
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"path/filepath"
 	"time"
-	"os/exec"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/vishvananda/netlink"
-	"strings"
-	"os"
+	"github.com/vishvananda/netns"
 )
 
-// Generate a mac addr
+// Generate a mac addr from an IPv4 address, 7a:42 is locally administered
 func makeMac(ip net.IP) string {
 	hw := make(net.HardwareAddr, 6)
 	hw[0] = 0x7a
@@ -21,13 +21,13 @@ func makeMac(ip net.IP) string {
 	return hw.String()
 }
 
-// Return the IPv4 address of a network interface
-func getIfaceAddr(name string) (*net.IPNet, error) {
+// Return the first address of a family on a network interface
+func getIfaceAddr(name string, family int) (*net.IPNet, error) {
 	iface, err := netlink.LinkByName(name)
 	if err != nil {
 		return nil, err
 	}
-	addrs, err := netlink.AddrList(iface, netlink.FAMILY_V4)
+	addrs, err := netlink.AddrList(iface, family)
 	if err != nil {
 		return nil, err
 	}
@@ -35,11 +35,38 @@ func getIfaceAddr(name string) (*net.IPNet, error) {
 		return nil, fmt.Errorf("Interface %s has no IP addresses", name)
 	}
 	if len(addrs) > 1 {
-		log.Infof("Interface [ %v ] has more than 1 IPv4 address. Defaulting to using [ %v ]\n", name, addrs[0].IP)
+		log.Infof("Interface [ %v ] has more than 1 address. Defaulting to using [ %v ]\n", name, addrs[0].IP)
 	}
 	return addrs[0].IPNet, nil
 }
 
+// Set the alias of a netlink interface
+func setIfaceAlias(name string, alias string) error {
+	iface, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkSetAlias(iface, alias)
+}
+
+// Check if a netlink interface already carries an address
+func ifaceHasAddr(name string, ip net.IP) bool {
+	iface, err := netlink.LinkByName(name)
+	if err != nil {
+		return false
+	}
+	addrs, err := netlink.AddrList(iface, netlink.FAMILY_ALL)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // Set the IP addr of a netlink interface
 func setInterfaceIP(name string, rawIP string) error {
 	retries := 2
@@ -54,14 +81,14 @@ func setInterfaceIP(name string, rawIP string) error {
 		time.Sleep(2 * time.Second)
 	}
 	if err != nil {
-		log.Fatalf("Abandoning retrieving the new bridge link from netlink, Run [ ip link ] to troubleshoot the error: %s", err)
-		return err
+		log.Errorf("Abandoning retrieving the new bridge link from netlink, Run [ ip link ] to troubleshoot the error: %s", err)
+		return fmt.Errorf("could not add %s to %s: %s", rawIP, name, err)
 	}
 	ipNet, err := netlink.ParseIPNet(rawIP)
 	if err != nil {
 		return err
 	}
-	addr := &netlink.Addr{ipNet, "", 0, 0}
+	addr := &netlink.Addr{IPNet: ipNet}
 	return netlink.AddrAdd(iface, addr)
 }
 
@@ -79,14 +106,14 @@ func delInterfaceIP(name string, rawIP string) error {
 		time.Sleep(2 * time.Second)
 	}
 	if err != nil {
-		log.Fatalf("Abandoning retrieving the link from netlink, Run [ ip link ] to troubleshoot the error: %s", err)
-		return err
+		log.Errorf("Abandoning retrieving the link from netlink, Run [ ip link ] to troubleshoot the error: %s", err)
+		return fmt.Errorf("could not delete %s from %s: %s", rawIP, name, err)
 	}
 	ipNet, err := netlink.ParseIPNet(rawIP)
 	if err != nil {
 		return err
 	}
-	addr := &netlink.Addr{ipNet, "", 0, 0}
+	addr := &netlink.Addr{IPNet: ipNet}
 	if err := netlink.AddrDel(iface, addr); err != nil {
 		log.Debugf("error delete addr [%s] for interface [%s]", rawIP, name)
 	}
@@ -118,47 +145,115 @@ func validateIface(ifaceStr string) bool {
 	return true
 }
 
-func updateDefaultGW4Container(container string, ip string) (string, error) {
-	log.Infoln("updateDefaultGW4Container")
-
-	exec.Command("mkdir", "-p", "/var/run/netns").Run()
-	pid, err := exec.Command("docker", "inspect", "-f", "'{{.State.Pid}}'", container).Output()
+// setLinkMac sets the MAC of a link, an empty mac leaves the kernel's
+func setLinkMac(name string, mac string) error {
+	if mac == "" {
+		return nil
+	}
+	hw, err := net.ParseMAC(mac)
 	if err != nil {
-		log.Infoln("docker inspect error!", err)
-		return "", err
+		return err
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
 	}
+	return netlink.LinkSetHardwareAddr(link, hw)
+}
 
-	srcFile := "/host/proc/"+strings.Split(string(pid), "'")[1]+"/ns/net"
-	dstFile := "/var/run/netns/"+container
-	log.Infoln("srcFile: ", srcFile)
-	log.Infoln("dstFile: ", dstFile)
+// setLinkMTU sets the MTU of a link unless it already has it
+func setLinkMTU(name string, mtu int) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	if link.Attrs().MTU == mtu {
+		return nil
+	}
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		return fmt.Errorf("could not set MTU of %s to %d: %s", name, mtu, err)
+	}
+	log.Debugf("Set MTU of [ %s ] to [ %d ]", name, mtu)
+	return nil
+}
 
-	if err := os.Symlink(srcFile, dstFile); err != nil {
-		log.Infoln("ln -s error!", err)
+// setSysctl writes a value under /proc/sys. The name is given as a path
+// (net/ipv4/ip_forward) so that interface names with dots are left alone.
+func setSysctl(name string, value string) error {
+	path := filepath.Join("/proc/sys", name)
+	if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("could not set %s to %s: %s", name, value, err)
 	}
+	return nil
+}
 
-	gateway, err := exec.Command("ip", "netns", "exec", container,
-					"ip", "route", "|", "grep", "default", "|",
-					"cut", "-d", "' '", "-f", "3").Output()
+// setSandboxGateway points the default IPv4 route of a sandbox at gateway
+// and returns the gateway it replaced, if there was one
+func setSandboxGateway(sandboxKey string, gateway string) (string, error) {
+	gw := net.ParseIP(gateway)
+	if gw == nil {
+		return "", fmt.Errorf("invalid gateway address %s", gateway)
+	}
+	ns, err := netns.GetFromPath(sandboxKey)
 	if err != nil {
-		log.Infoln("ip route | grep default | cut -d ' ' -f 3 error!", err)
-		//return "", err
+		return "", fmt.Errorf("could not open sandbox %s: %s", sandboxKey, err)
 	}
-	log.Infof("=========gwteway:%s", string(gateway))
-
-	if err := exec.Command("ip", "netns", "exec", container,
-					"ip", "route", "del", "default").Run(); err != nil {
-		log.Infoln("ip route del default error!", err)
+	defer ns.Close()
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return "", fmt.Errorf("could not get a netlink handle in sandbox %s: %s", sandboxKey, err)
 	}
+	defer h.Delete()
 
-	if err := exec.Command("ip", "netns", "exec", container,"ip",
-					"route", "add", "default", "via", ip).Run(); err != nil {
-		log.Infoln("ip route add default via ip error!", err)
+	// The interface is moved into the sandbox after the join is answered,
+	// wait until the gateway is on a link inside it
+	retries := 5
+	for i := 0; i < retries; i++ {
+		var routes []netlink.Route
+		if routes, err = h.RouteGet(gw); err == nil && len(routes) > 0 && routes[0].Gw == nil {
+			break
+		}
+		if err == nil {
+			err = fmt.Errorf("no link to the gateway")
+		}
+		log.Debugf("Gateway [ %s ] not reachable in sandbox [ %s ] yet... retrying", gateway, sandboxKey)
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		return "", fmt.Errorf("gateway %s is not reachable in sandbox %s: %s", gateway, sandboxKey, err)
 	}
 
-	if err := exec.Command("rm", dstFile).Run(); err != nil {
-		log.Infoln("rm link error!", err)
+	routes, err := h.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return "", err
+	}
+	var old *netlink.Route
+	for i := range routes {
+		if routes[i].Dst == nil {
+			old = &routes[i]
+			break
+		}
+	}
+	if old != nil && old.Gw.Equal(gw) {
+		log.Debugf("Default route of sandbox [ %s ] already goes through [ %s ]", sandboxKey, gateway)
+		return "", nil
 	}
 
-	return string(gateway), nil
-}
\ No newline at end of file
+	origin := ""
+	if old != nil {
+		origin = old.Gw.String()
+		if err := h.RouteDel(old); err != nil {
+			return "", fmt.Errorf("could not delete default route via %s in sandbox %s: %s", origin, sandboxKey, err)
+		}
+	}
+	if err := h.RouteAdd(&netlink.Route{Gw: gw}); err != nil {
+		if old != nil {
+			if rerr := h.RouteAdd(old); rerr != nil {
+				log.Errorf("Could not restore default route via [ %s ] in sandbox [ %s ]: %s", origin, sandboxKey, rerr)
+			}
+		}
+		return "", fmt.Errorf("could not add default route via %s in sandbox %s: %s", gateway, sandboxKey, err)
+	}
+	log.Infof("Default route of sandbox [ %s ] changed from [ %s ] to [ %s ]", sandboxKey, origin, gateway)
+	return origin, nil
+}
@@ -0,0 +1,153 @@
+package bridge
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	vxlanPrefix      = "vx-"
+	defaultVxlanPort = 4789
+
+	// vxlanOverhead is what the outer IPv4, UDP and VXLAN headers and the
+	// inner ethernet header take from the MTU of the underlay
+	vxlanOverhead = 50
+)
+
+// vxlanConfig is the overlay part of a network's options
+type vxlanConfig struct {
+	id    int
+	peers []string
+	group string
+	port  int
+}
+
+// getVxlanConfig checks the vxlan options of a network. The VNI is
+// required, and so is either a list of peer hosts, which get static flood
+// entries, or a multicast group.
+func getVxlanConfig(config *networkConfig) (*vxlanConfig, error) {
+	c := &vxlanConfig{
+		id:    config.VxlanID,
+		peers: config.VxlanPeers,
+		group: config.VxlanGroup,
+		port:  config.VxlanPort,
+	}
+	if c.id == 0 {
+		return nil, fmt.Errorf("%s mode needs %s", modeVxlan, vxlanIDOption)
+	}
+	if c.port == 0 {
+		c.port = defaultVxlanPort
+	}
+	for _, peer := range c.peers {
+		if net.ParseIP(peer) == nil {
+			return nil, fmt.Errorf("%s: %s is not an IP address", vxlanPeersOption, peer)
+		}
+	}
+	if c.group != "" {
+		if group := net.ParseIP(c.group); group == nil || !group.IsMulticast() {
+			return nil, fmt.Errorf("%s: %s is not a multicast address", vxlanGroupOption, c.group)
+		}
+	}
+
+	switch {
+	case len(c.peers) == 0 && c.group == "":
+		return nil, fmt.Errorf("%s mode needs %s or %s", modeVxlan, vxlanPeersOption, vxlanGroupOption)
+	case len(c.peers) > 0 && c.group != "":
+		return nil, fmt.Errorf("%s and %s can not be used together", vxlanPeersOption, vxlanGroupOption)
+	}
+	return c, nil
+}
+
+// setupVxlan plugs the VXLAN device of a network into its bridge. The bridge
+// keeps the gateway on every host, so it gets a MAC derived from the gateway
+// address to look like the same router wherever a container runs.
+func setupVxlan(networkID string, network *NetworkState) error {
+	br, err := netlink.LinkByName(network.BridgeName)
+	if err != nil {
+		return err
+	}
+	if gateway := net.ParseIP(network.Gateway); gateway != nil {
+		mac, _ := net.ParseMAC(makeMac(gateway))
+		if err := netlink.LinkSetHardwareAddr(br, mac); err != nil {
+			log.Warnf("Could not set gateway MAC on bridge [ %s ]: %s", network.BridgeName, err)
+		}
+	}
+
+	if err := createVxlan(network); err != nil {
+		return err
+	}
+	if err := setIfaceAlias(network.VxlanInterface, bridgeAliasPrefix+networkID); err != nil {
+		log.Warnf("Could not set alias on vxlan interface [ %s ]: %s", network.VxlanInterface, err)
+	}
+	if err := addVxlanPeers(network.VxlanInterface, network.VxlanPeers); err != nil {
+		return err
+	}
+	return attachUplink(network.BridgeName, network.VxlanInterface, false)
+}
+
+// createVxlan adds the VXLAN device of a network, reusing it if it is
+// already there
+func createVxlan(network *NetworkState) error {
+	name := network.VxlanInterface
+	if link, err := netlink.LinkByName(name); err == nil {
+		if vxlan, ok := link.(*netlink.Vxlan); ok && vxlan.VxlanId == network.VxlanID {
+			log.Debugf("Reusing vxlan interface [ %s ]", name)
+			return nil
+		}
+		return fmt.Errorf("interface %s exists and is not vxlan %d", name, network.VxlanID)
+	}
+
+	vxlan := &netlink.Vxlan{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		VxlanId:   network.VxlanID,
+		Port:      network.VxlanPort,
+		Learning:  true,
+	}
+	if network.VxlanGroup != "" {
+		vxlan.Group = net.ParseIP(network.VxlanGroup)
+	}
+	if network.FlatBindInterface != "" {
+		nic, err := netlink.LinkByName(network.FlatBindInterface)
+		if err != nil {
+			return fmt.Errorf("bind interface %s not found: %s", network.FlatBindInterface, err)
+		}
+		vxlan.VtepDevIndex = nic.Attrs().Index
+		if addr, err := getIfaceAddr(network.FlatBindInterface, netlink.FAMILY_V4); err == nil {
+			vxlan.SrcAddr = addr.IP
+		}
+	}
+	if err := netlink.LinkAdd(vxlan); err != nil {
+		return fmt.Errorf("could not create vxlan interface %s: %s", name, err)
+	}
+	log.Infof("Created vxlan interface [ %s ] with vni [ %d ]", name, network.VxlanID)
+	return nil
+}
+
+// addVxlanPeers adds an all zero forwarding entry per peer, so that
+// broadcasts and unknown unicasts are sent to every peer and the bridge
+// learns where each container lives from the answers
+func addVxlanPeers(name string, peers []string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		fdb := &netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			Family:       syscall.AF_BRIDGE,
+			State:        netlink.NUD_PERMANENT,
+			Flags:        netlink.NTF_SELF,
+			IP:           net.ParseIP(peer),
+			HardwareAddr: make(net.HardwareAddr, 6),
+		}
+		if err := netlink.NeighAppend(fdb); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("could not add vxlan peer %s to %s: %s", peer, name, err)
+		}
+		log.Debugf("Added vxlan peer [ %s ] to [ %s ]", peer, name)
+	}
+	return nil
+}
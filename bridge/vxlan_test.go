@@ -0,0 +1,61 @@
+package bridge
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetVxlanConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config networkConfig
+		want   *vxlanConfig
+	}{
+		{
+			name:   "peers",
+			config: networkConfig{VxlanID: 42, VxlanPeers: []string{"10.0.0.1", "10.0.0.2"}},
+			want:   &vxlanConfig{id: 42, peers: []string{"10.0.0.1", "10.0.0.2"}, port: defaultVxlanPort},
+		},
+		{
+			name:   "group",
+			config: networkConfig{VxlanID: 42, VxlanGroup: "239.1.1.1", VxlanPort: 8472},
+			want:   &vxlanConfig{id: 42, group: "239.1.1.1", port: 8472},
+		},
+		{
+			name:   "no VNI",
+			config: networkConfig{VxlanPeers: []string{"10.0.0.1"}},
+		},
+		{
+			name:   "neither peers nor group",
+			config: networkConfig{VxlanID: 42},
+		},
+		{
+			name:   "both peers and group",
+			config: networkConfig{VxlanID: 42, VxlanPeers: []string{"10.0.0.1"}, VxlanGroup: "239.1.1.1"},
+		},
+		{
+			name:   "peer is not an address",
+			config: networkConfig{VxlanID: 42, VxlanPeers: []string{"host1"}},
+		},
+		{
+			name:   "group is not multicast",
+			config: networkConfig{VxlanID: 42, VxlanGroup: "10.0.0.1"},
+		},
+	}
+	for _, test := range tests {
+		c, err := getVxlanConfig(&test.config)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.name, c)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(c, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, c, test.want)
+		}
+	}
+}
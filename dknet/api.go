@@ -12,10 +12,9 @@ import (
 )
 
 const (
-	defaultContentTypeV1_1        = "application/vnd.docker.plugins.v1.1+json"
-	defaultImplementationManifest = `{"Implements": ["NetworkDriver"]}`
-	defaultScope                  = `{"Scope": "local"}`
-	emptyResponse                 = `{}`
+	defaultContentTypeV1_1 = "application/vnd.docker.plugins.v1.1+json"
+	defaultScope           = "local"
+	emptyResponse          = `{}`
 
 	activatePath       = "/Plugin.Activate"
 	capabilitiesPath   = "/NetworkDriver.GetCapabilities"
@@ -41,6 +40,20 @@ type Driver interface {
 	Leave(*LeaveRequest) error
 }
 
+// EndpointResponder can be implemented by a Driver that fills in parts of
+// the endpoint interface docker left empty, such as the MAC address.
+// CreateEndpointResponse is then called instead of CreateEndpoint.
+type EndpointResponder interface {
+	CreateEndpointResponse(*CreateEndpointRequest) (*CreateEndpointResponse, error)
+}
+
+// Scoper can be implemented by a Driver whose networks span hosts. Scope
+// returns "local" or "global" and is advertised to docker in the
+// capabilities.
+type Scoper interface {
+	Scope() string
+}
+
 type CreateNetworkRequest struct {
 	NetworkID string
 	Options   map[string]interface{}
@@ -66,6 +79,10 @@ type CreateEndpointRequest struct {
 	Options    map[string]interface{}
 }
 
+type CreateEndpointResponse struct {
+	Interface *EndpointInterface
+}
+
 type EndpointInterface struct {
 	Address     string
 	AddressIPv6 string
@@ -83,8 +100,8 @@ type InterfaceName struct {
 }
 
 type InfoRequest struct {
-	NetworkID string
-	EnpointID string
+	NetworkID  string
+	EndpointID string
 }
 
 type InfoResponse struct {
@@ -106,6 +123,7 @@ type StaticRoute struct {
 
 type JoinResponse struct {
 	Gateway       string
+	GatewayIPv6   string
 	InterfaceName InterfaceName
 	StaticRoutes  []*StaticRoute
 }
@@ -126,17 +144,24 @@ type Handler struct {
 func NewHandler(driver Driver) *Handler {
 	h := &Handler{driver, http.NewServeMux()}
 	h.initMux()
+	if ipam, ok := driver.(IpamDriver); ok {
+		h.initIpamMux(ipam)
+	}
 	return h
 }
 
 func (h *Handler) initMux() {
 	h.mux.HandleFunc(activatePath, func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", defaultContentTypeV1_1)
-		fmt.Fprintln(w, defaultImplementationManifest)
+		json.NewEncoder(w).Encode(h.manifest())
 	})
 
 	h.mux.HandleFunc(capabilitiesPath, func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, defaultScope)
+		scope := defaultScope
+		if scoper, ok := h.driver.(Scoper); ok {
+			scope = scoper.Scope()
+		}
+		objectResponse(w, map[string]string{"Scope": scope})
 	})
 
 	h.mux.HandleFunc(createNetworkPath, func(w http.ResponseWriter, r *http.Request) {
@@ -174,6 +199,15 @@ func (h *Handler) initMux() {
 			badRequestResponse(w)
 			return
 		}
+		if responder, ok := h.driver.(EndpointResponder); ok {
+			res, err := responder.CreateEndpointResponse(req)
+			if err != nil {
+				errorResponse(w, err)
+				return
+			}
+			objectResponse(w, res)
+			return
+		}
 		err = h.driver.CreateEndpoint(req)
 		if err != nil {
 			errorResponse(w, err)
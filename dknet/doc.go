@@ -0,0 +1,5 @@
+// Package dknet serves the docker network plugin API. It started as a copy of
+// github.com/gopher-net/dknet 0.1 (72c72f2) and is kept here because the
+// driver uses parts of the API the upstream does not have: endpoint
+// responses, the driver scope and the IPAM driver.
+package dknet
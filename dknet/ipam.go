@@ -0,0 +1,148 @@
+package dknet
+
+import (
+	"net/http"
+)
+
+const (
+	ipamCapabilitiesPath  = "/IpamDriver.GetCapabilities"
+	addressSpacesPath     = "/IpamDriver.GetDefaultAddressSpaces"
+	requestPoolPath       = "/IpamDriver.RequestPool"
+	releasePoolPath       = "/IpamDriver.ReleasePool"
+	requestAddressPath    = "/IpamDriver.RequestAddress"
+	releaseAddressPath    = "/IpamDriver.ReleaseAddress"
+	networkDriverManifest = "NetworkDriver"
+	ipamDriverManifest    = "IpamDriver"
+)
+
+// IpamDriver can be implemented by a Driver that also manages addresses.
+// The handler then serves the IPAM protocol on the same socket.
+type IpamDriver interface {
+	GetIpamCapabilities() (*IpamCapabilitiesResponse, error)
+	GetDefaultAddressSpaces() (*AddressSpacesResponse, error)
+	RequestPool(*RequestPoolRequest) (*RequestPoolResponse, error)
+	ReleasePool(*ReleasePoolRequest) error
+	RequestAddress(*RequestAddressRequest) (*RequestAddressResponse, error)
+	ReleaseAddress(*ReleaseAddressRequest) error
+}
+
+type IpamCapabilitiesResponse struct {
+	RequiresMACAddress bool
+}
+
+type AddressSpacesResponse struct {
+	LocalDefaultAddressSpace  string
+	GlobalDefaultAddressSpace string
+}
+
+type RequestPoolRequest struct {
+	AddressSpace string
+	Pool         string
+	SubPool      string
+	Options      map[string]string
+	V6           bool
+}
+
+type RequestPoolResponse struct {
+	PoolID string
+	Pool   string
+	Data   map[string]string
+}
+
+type ReleasePoolRequest struct {
+	PoolID string
+}
+
+type RequestAddressRequest struct {
+	PoolID  string
+	Address string
+	Options map[string]string
+}
+
+type RequestAddressResponse struct {
+	Address string
+	Data    map[string]string
+}
+
+type ReleaseAddressRequest struct {
+	PoolID  string
+	Address string
+}
+
+// manifest lists the plugin types the driver implements
+func (h *Handler) manifest() map[string][]string {
+	implements := []string{networkDriverManifest}
+	if _, ok := h.driver.(IpamDriver); ok {
+		implements = append(implements, ipamDriverManifest)
+	}
+	return map[string][]string{"Implements": implements}
+}
+
+func (h *Handler) initIpamMux(ipam IpamDriver) {
+	h.mux.HandleFunc(ipamCapabilitiesPath, func(w http.ResponseWriter, r *http.Request) {
+		res, err := ipam.GetIpamCapabilities()
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		objectResponse(w, res)
+	})
+	h.mux.HandleFunc(addressSpacesPath, func(w http.ResponseWriter, r *http.Request) {
+		res, err := ipam.GetDefaultAddressSpaces()
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		objectResponse(w, res)
+	})
+	h.mux.HandleFunc(requestPoolPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &RequestPoolRequest{}
+		if err := decodeRequest(r, req); err != nil {
+			badRequestResponse(w)
+			return
+		}
+		res, err := ipam.RequestPool(req)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		objectResponse(w, res)
+	})
+	h.mux.HandleFunc(releasePoolPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &ReleasePoolRequest{}
+		if err := decodeRequest(r, req); err != nil {
+			badRequestResponse(w)
+			return
+		}
+		if err := ipam.ReleasePool(req); err != nil {
+			errorResponse(w, err)
+			return
+		}
+		successResponse(w)
+	})
+	h.mux.HandleFunc(requestAddressPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &RequestAddressRequest{}
+		if err := decodeRequest(r, req); err != nil {
+			badRequestResponse(w)
+			return
+		}
+		res, err := ipam.RequestAddress(req)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		objectResponse(w, res)
+	})
+	h.mux.HandleFunc(releaseAddressPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &ReleaseAddressRequest{}
+		if err := decodeRequest(r, req); err != nil {
+			badRequestResponse(w)
+			return
+		}
+		if err := ipam.ReleaseAddress(req); err != nil {
+			errorResponse(w, err)
+			return
+		}
+		successResponse(w)
+	})
+}
@@ -2,15 +2,19 @@ package main
 
 import (
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
-	"github.com/gopher-net/dknet"
+	"github.com/chenleji/docker-bridge-plugin/dknet"
 	"github.com/chenleji/docker-bridge-plugin/bridge"
 )
 
 const (
-	version = "0.2"
+	version    = "0.2"
+	pluginName = "wise2c-bridge"
 )
 
 func main() {
@@ -19,12 +23,45 @@ func main() {
 		Name:  "debug, d",
 		Usage: "enable debugging",
 	}
+	var flagFipPool = cli.StringFlag{
+		Name:  "fip-pool",
+		Usage: "comma separated CIDRs or IP ranges (a.b.c.d-a.b.c.e) to allocate floating IPs from",
+	}
+	var flagStateDir = cli.StringFlag{
+		Name:  "state-dir",
+		Value: "/var/lib/docker-bridge-plugin",
+		Usage: "directory the driver state is kept in across restarts",
+	}
+	var flagGCInterval = cli.IntFlag{
+		Name:  "gc-interval",
+		Value: 600,
+		Usage: "seconds between garbage collections of orphaned links, floating IPs and rules, 0 to disable. SIGUSR1 triggers one at any time",
+	}
+	var flagScope = cli.StringFlag{
+		Name:  "scope",
+		Value: "local",
+		Usage: "local, or global for networks that span the hosts sharing the cluster store",
+	}
+	var flagClusterStore = cli.StringFlag{
+		Name:  "cluster-store",
+		Usage: "URL of the store network definitions and floating IP claims are shared through (file:///path/to/shared/dir)",
+	}
+	var flagIpamPools = cli.StringFlag{
+		Name:  "ipam-pools",
+		Usage: "comma separated CIDRs the IPAM driver gives to networks created without a subnet",
+	}
 	app := cli.NewApp()
 	app.Name = "don"
 	app.Usage = "Docker Linux Bridge Networking"
 	app.Version = version
 	app.Flags = []cli.Flag{
 		flagDebug,
+		flagFipPool,
+		flagStateDir,
+		flagGCInterval,
+		flagScope,
+		flagClusterStore,
+		flagIpamPools,
 	}
 	app.Action = Run
 	app.Run(os.Args)
@@ -36,10 +73,36 @@ func Run(ctx *cli.Context) {
 		log.SetLevel(log.DebugLevel)
 	}
 
-	d, err := bridge.NewDriver()
+	d, err := bridge.NewDriver(&bridge.Config{
+		FipPool:      ctx.String("fip-pool"),
+		StateDir:     ctx.String("state-dir"),
+		DriverName:   pluginName,
+		Scope:        ctx.String("scope"),
+		ClusterStore: ctx.String("cluster-store"),
+		IpamPools:    ctx.String("ipam-pools"),
+	})
 	if err != nil {
 		panic(err)
 	}
+	// The socket is served right away, docker may need the plugin to
+	// restore its containers before it answers the reconciliation
+	go func() {
+		if err := d.Reconcile(); err != nil {
+			log.Warnf("Could not reconcile with the docker daemon: %s", err)
+		}
+		d.CollectGarbage()
+		if interval := ctx.Int("gc-interval"); interval > 0 {
+			d.StartGC(time.Duration(interval) * time.Second)
+		}
+	}()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	go func() {
+		for range sigs {
+			d.CollectGarbage()
+		}
+	}()
+
 	h := dknet.NewHandler(d)
-	h.ServeUnix("root", "wise2c-bridge")
+	h.ServeUnix("root", pluginName)
 }